@@ -1,16 +1,38 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	// the alpine image has no zoneinfo for TIME_WINDOWS_TIMEZONE
+	_ "time/tzdata"
+	"unicode"
 	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/dyatlov/go-htmlinfo/htmlinfo"
 	"github.com/goware/urlx"
@@ -19,6 +41,7 @@ import (
 
 	"github.com/NicoNex/echotron/v3"
 	"github.com/spf13/viper"
+	"golang.org/x/net/html/charset"
 )
 
 const (
@@ -28,24 +51,55 @@ const (
 type UrlExtractor func(msg *echotron.Message) []string
 
 func GetUrlsFromEntities(msg *echotron.Message) []string {
+	return urlsFromEntities(msg.Text, msg.Entities)
+}
+
+// GetUrlsFromCaptionEntities extracts the links in the caption of media messages, e.g. a photo shared with its
+// source. It's a separate extractor so that media forwards can be ignored by leaving it out
+func GetUrlsFromCaptionEntities(msg *echotron.Message) []string {
+	// caption entity offsets point into the caption, not the text
+	return urlsFromEntities(msg.Caption, msg.CaptionEntities)
+}
+
+func urlsFromEntities(text string, entities []*echotron.MessageEntity) []string {
 	urls := make([]string, 0)
-	allEntities := make([]*echotron.MessageEntity, 0, len(msg.Entities)+len(msg.CaptionEntities))
-	allEntities = append(allEntities, msg.Entities...)
-	allEntities = append(allEntities, msg.CaptionEntities...)
-	for _, entity := range allEntities {
+	for _, entity := range entities {
 		if entity.Type != "url" && entity.Type != "text_link" {
 			continue
 		}
 		entityUrl := entity.URL
 		if entityUrl == "" {
-			// offset and length are in UTF-16 code units
-			entityUrl = sliceUtf16(msg.Text, entity.Offset, entity.Offset+entity.Length)
+			var ok bool
+			if entityUrl, ok = entityText(text, entity); !ok {
+				continue
+			}
 		}
 		urls = append(urls, entityUrl)
 	}
 	return urls
 }
 
+// GetUrlsFromViaBot extracts the URL buttons of messages sent through an inline bot, which often carry the
+// shared link in the keyboard rather than in the text
+func GetUrlsFromViaBot(msg *echotron.Message) []string {
+	urls := make([]string, 0)
+	if msg.ViaBot == nil || msg.ReplyMarkup == nil {
+		return urls
+	}
+	for _, row := range msg.ReplyMarkup.InlineKeyboard {
+		for _, button := range row {
+			if button.URL != "" {
+				urls = append(urls, button.URL)
+			}
+		}
+	}
+	return urls
+}
+
+// GetUrlsFromLinkPreview returns the URL the message preview was generated for. It may differ from the URLs in the
+// text when the sender picked another link for the preview, and if it's also in the text GetUrlsWithExtractors
+// drops the duplicate. PreferSmallMedia, PreferLargeMedia and ShowAboveText only change the preview layout,
+// so they don't affect the URL
 func GetUrlsFromLinkPreview(msg *echotron.Message) []string {
 	link := msg.LinkPreviewOptions
 	urls := make([]string, 0)
@@ -58,16 +112,338 @@ func GetUrlsFromLinkPreview(msg *echotron.Message) []string {
 // GetUrlsWithExtractors returns a new UrlExtractor that combines the results of the provided extractors (order preserved)
 func GetUrlsWithExtractors(extractors ...UrlExtractor) UrlExtractor {
 	return func(msg *echotron.Message) []string {
-		urls := make([]string, 0)
+		urls, _ := extractUrls(msg, extractors, UrlNormalization{})
+		return urls
+	}
+}
+
+// extractUrls combines the results of the extractors like GetUrlsWithExtractors, deduplicating them with the
+// normalization, and counts the URLs each of them found before deduplication, keyed by the extractor name
+func extractUrls(
+	msg *echotron.Message,
+	extractors []UrlExtractor,
+	normalization UrlNormalization,
+) ([]string, log.Fields) {
+	urls := make([]string, 0)
+	counts := log.Fields{}
+	for _, extractor := range extractors {
+		found := extractor(msg)
+		for _, u := range found {
+			urls = append(urls, trimUrlWrapping(u))
+		}
+		counts[extractorName(extractor)] = len(found)
+	}
+	return distinctUrls(urls, normalization), counts
+}
+
+// extractorName returns the function name of the extractor, e.g. "GetUrlsFromEntities"
+func extractorName(extractor UrlExtractor) string {
+	name := runtime.FuncForPC(reflect.ValueOf(extractor).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// NewUrlExtractors returns the extractors the bot runs on every message, in the order their URLs are saved. Caption
+// URLs are only extracted with saveCaptionUrls
+func NewUrlExtractors(saveCaptionUrls bool) []UrlExtractor {
+	extractors := []UrlExtractor{GetUrlsFromLinkPreview, GetUrlsFromEntities}
+	if saveCaptionUrls {
+		extractors = append(extractors, GetUrlsFromCaptionEntities)
+	}
+	return append(extractors, GetUrlsFromViaBot)
+}
+
+// messageUrls extracts the URLs of the message with the extractors and returns all of them, which tell messages
+// without URLs apart, as well as the valid ones that are saved
+func messageUrls(
+	logger *log.Entry,
+	msg *echotron.Message,
+	extractors []UrlExtractor,
+	options BotOptions,
+) (urls, valid []string) {
+	urls, counts := extractUrls(msg, extractors, options.UrlNormalization)
+	valid = filterValidUrls(logger, urls, options.AllowedSchemes, options.RedactUrlsInLogs)
+	counts["distinct"], counts["valid"] = len(urls), len(valid)
+	logger.WithFields(counts).Debug("Extracted URLs")
+	return urls, valid
+}
+
+// ExtractUrlsFromUpdateJSON returns the URLs the bot would save from the message of a raw update as received from
+// Telegram, before MaxUrlsPerMessage applies, which reproduces extraction bugs from captured updates. Pass the
+// extractors and options of the bot, e.g. NewUrlExtractors(true). Updates without a message have no URLs
+func ExtractUrlsFromUpdateJSON(jsonBytes []byte, extractors []UrlExtractor, options BotOptions) ([]string, error) {
+	var update echotron.Update
+	if err := json.Unmarshal(jsonBytes, &update); err != nil {
+		return nil, errorx.Decorate(err, "failed to unmarshal update")
+	}
+	msg := update.Message
+	if msg == nil {
+		msg = update.BusinessMessage
+	}
+	if msg == nil {
+		return []string{}, nil
+	}
+	_, valid := messageUrls(log.NewEntry(log.StandardLogger()), msg, extractors, options)
+	return valid, nil
+}
+
+// distinctUrls drops URLs that normalize to one already seen, e.g. "https://X.com/" after "https://x.com",
+// keeping the first form
+func distinctUrls(urls []string, normalization UrlNormalization) []string {
+	unique := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, u := range urls {
+		key := urlDedupKey(u, normalization)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, u)
+		}
+	}
+	return unique
+}
+
+var urlClosingBrackets = map[rune]rune{')': '(', ']': '[', '>': '<', '}': '{'}
+
+// trimUrlWrapping strips brackets, quotes and punctuation that leaked into the URL from the surrounding text.
+// Closing brackets are kept when they are balanced within the URL (e.g. https://en.wikipedia.org/wiki/Go_(game))
+func trimUrlWrapping(u string) string {
+	u = strings.TrimLeft(strings.TrimSpace(u), "([<{\"'`")
+	for u != "" {
+		last, size := utf8.DecodeLastRuneInString(u)
+		if strings.ContainsRune(".,;:!?\"'`", last) {
+			u = u[:len(u)-size]
+			continue
+		}
+		opening, isClosing := urlClosingBrackets[last]
+		if isClosing && strings.Count(u, string(last)) > strings.Count(u, string(opening)) {
+			u = u[:len(u)-size]
+			continue
+		}
+		break
+	}
+	return u
+}
+
+type TagExtractor func(msg *echotron.Message) []string
+
+// GetTagsFromMentions returns a tag for every user mentioned in the message
+func GetTagsFromMentions(msg *echotron.Message) []string {
+	tags := make([]string, 0)
+	for _, entity := range msg.Entities {
+		var name string
+		switch {
+		case entity.Type == "text_mention" && entity.User != nil && entity.User.Username != "":
+			name = entity.User.Username
+		case entity.Type == "text_mention" || entity.Type == "mention":
+			mention, ok := entityText(msg.Text, entity)
+			if !ok {
+				continue
+			}
+			name = strings.TrimPrefix(mention, "@")
+		default:
+			continue
+		}
+		if tag := sanitizeTag(name); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// GetTagsWithExtractors returns a new TagExtractor that combines the results of the provided extractors (order preserved)
+func GetTagsWithExtractors(extractors ...TagExtractor) TagExtractor {
+	return func(msg *echotron.Message) []string {
+		tags := make([]string, 0)
 		for _, extractor := range extractors {
-			urls = append(urls, extractor(msg)...)
+			tags = append(tags, extractor(msg)...)
+		}
+		return distinct(tags)
+	}
+}
+
+// FavoriteHashtag marks a message whose link is important
+const FavoriteHashtag = "fav"
+
+// GetFavoriteTag returns a TagExtractor adding the tag to messages marked with #fav
+func GetFavoriteTag(tag string) TagExtractor {
+	return func(msg *echotron.Message) []string {
+		if contains(GetHashtags(msg), FavoriteHashtag) {
+			return []string{tag}
+		}
+		return []string{}
+	}
+}
+
+// GetTagsFromAliases returns a TagExtractor expanding the hashtags that are aliases into their tags,
+// e.g. #r into reading and to-read. Other hashtags are left alone
+func GetTagsFromAliases(aliases map[string][]string) TagExtractor {
+	return func(msg *echotron.Message) []string {
+		tags := make([]string, 0)
+		for _, hashtag := range GetHashtags(msg) {
+			tags = append(tags, aliases[hashtag]...)
+		}
+		return tags
+	}
+}
+
+// parseTagAliases parses a list of "alias=tag1 tag2" entries, e.g. "r=reading to-read". Aliases are matched
+// against lowercased hashtags, so they are lowercased as well
+func parseTagAliases(entries []string) (map[string][]string, error) {
+	aliases := make(map[string][]string, len(entries))
+	for _, entry := range entries {
+		alias, tags, found := strings.Cut(entry, "=")
+		alias = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(alias), "#"))
+		if !found || alias == "" || len(strings.Fields(tags)) == 0 {
+			return nil, errorx.IllegalArgument.New("invalid tag alias %q, expected alias=tag1 tag2", entry)
+		}
+		aliases[alias] = strings.Fields(tags)
+	}
+	return aliases, nil
+}
+
+// GetDateTag returns a TagExtractor tagging the message with the month it was sent in the location, e.g. "2024-06"
+func GetDateTag(location *time.Location) TagExtractor {
+	return func(msg *echotron.Message) []string {
+		return []string{time.Unix(int64(msg.Date), 0).In(location).Format("2006-01")}
+	}
+}
+
+// GetHashtags returns the lowercased hashtags of the message text and caption, without the leading #
+func GetHashtags(msg *echotron.Message) []string {
+	hashtags := hashtagsFromEntities(msg.Text, msg.Entities)
+	return append(hashtags, hashtagsFromEntities(msg.Caption, msg.CaptionEntities)...)
+}
+
+// DescriptionDirective starts a message line holding the description to save instead of the page's one
+const DescriptionDirective = "desc:"
+
+// GetDescription returns the value of the first "desc: ..." line of the message text or caption, empty if there is none
+func GetDescription(msg *echotron.Message) string {
+	for _, text := range []string{msg.Text, msg.Caption} {
+		for _, line := range strings.Split(text, "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) < len(DescriptionDirective) || !strings.EqualFold(line[:len(DescriptionDirective)], DescriptionDirective) {
+				continue
+			}
+			if description := strings.TrimSpace(line[len(DescriptionDirective):]); description != "" {
+				return description
+			}
+		}
+	}
+	return ""
+}
+
+func hashtagsFromEntities(text string, entities []*echotron.MessageEntity) []string {
+	hashtags := make([]string, 0)
+	for _, entity := range entities {
+		if entity.Type != "hashtag" {
+			continue
+		}
+		hashtag, ok := entityText(text, entity)
+		if !ok {
+			continue
+		}
+		hashtags = append(hashtags, strings.ToLower(strings.TrimPrefix(hashtag, "#")))
+	}
+	return hashtags
+}
+
+// sanitizeTag makes the name usable as a linkding tag, which can't contain whitespace
+func sanitizeTag(name string) string {
+	return strings.Join(strings.Fields(name), "_")
+}
+
+// DefaultAllowedSchemes are the schemes of pages that can be fetched
+var DefaultAllowedSchemes = []string{"http", "https"}
+
+// isValidUrl reports whether the URL has one of the schemes and a host. Scheme-less URLs (e.g. "example.com/page")
+// count as http since Telegram detects them as url entities
+func isValidUrl(raw string, schemes []string) bool {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	// "example.com:8080/page" is parsed as scheme "example.com" with an opaque port, unlike "mailto:..." or "tel:..."
+	if parsed.Scheme == "" || (parsed.Opaque != "" && unicode.IsDigit(rune(parsed.Opaque[0]))) {
+		if parsed, err = url.Parse("http://" + raw); err != nil {
+			return false
+		}
+	}
+	return contains(schemes, strings.ToLower(parsed.Scheme)) && parsed.Hostname() != ""
+}
+
+// normalizeSchemes lowercases the schemes and drops a trailing "://" or ":", e.g. "HTTPS://" becomes "https"
+func normalizeSchemes(schemes []string) []string {
+	normalized := make([]string, 0, len(schemes))
+	for _, scheme := range schemes {
+		scheme = strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(scheme)), "//"), ":")
+		if scheme != "" {
+			normalized = append(normalized, scheme)
+		}
+	}
+	return normalized
+}
+
+func filterValidUrls(logger *log.Entry, urls []string, schemes []string, redactUrls bool) []string {
+	valid := make([]string, 0, len(urls))
+	for _, u := range urls {
+		if !isValidUrl(u, schemes) {
+			logger.Debugf("Skipping invalid URL or URL with a scheme that isn't allowed: %s", logUrl(u, redactUrls))
+			continue
 		}
-		return distinct(urls)
+		valid = append(valid, u)
+	}
+	return valid
+}
+
+// entityText returns the part of the text the entity covers, ok is false and a warning is logged if the entity is
+// out of range
+func entityText(text string, entity *echotron.MessageEntity) (string, bool) {
+	// offset and length are in UTF-16 code units
+	substr, ok := sliceUtf16(text, entity.Offset, entity.Offset+entity.Length)
+	if !ok {
+		log.Warnf("Skipping %s entity with out of range offset %d and length %d", entity.Type, entity.Offset, entity.Length)
+	}
+	return substr, ok
+}
+
+// sliceUtf16 returns the substring between the UTF-16 code unit offsets, ok is false if the range is out of bounds.
+// Offsets landing in the middle of a surrogate pair are widened to include the whole pair
+func sliceUtf16(s string, start, end int) (substr string, ok bool) {
+	units := utf16.Encode([]rune(s))
+	if start < 0 || end < start || end > len(units) {
+		return "", false
+	}
+	if start > 0 && start < len(units) && isSurrogatePair(units[start-1], units[start]) {
+		start--
+	}
+	if end > 0 && end < len(units) && isSurrogatePair(units[end-1], units[end]) {
+		end++
 	}
+	return string(utf16.Decode(units[start:end])), true
 }
 
-func sliceUtf16(s string, start, end int) string {
-	return string(utf16.Decode(utf16.Encode([]rune(s))[start:end]))
+func isSurrogatePair(high, low uint16) bool {
+	return utf16.DecodeRune(rune(high), rune(low)) != utf8.RuneError
+}
+
+// urlDedupKey normalizes the URL for comparison. A slash-only path is dropped since it's the same page, other
+// trailing slashes are kept as servers may treat them differently. The scheme is dropped too, as a scheme-less
+// "example.com" in the text normalizes to http while its link preview is usually https. URLs that can't be
+// normalized are used as is
+func urlDedupKey(u string, normalization UrlNormalization) string {
+	normalized, err := normalizeUrl(u, normalization)
+	if err != nil {
+		return u
+	}
+	parsed, err := url.Parse(normalized)
+	if err != nil {
+		return normalized
+	}
+	if parsed.Path == "/" {
+		parsed.Path = ""
+	}
+	parsed.Scheme = ""
+	return parsed.String()
 }
 
 func distinct(arr []string) []string {
@@ -79,220 +455,2913 @@ func distinct(arr []string) []string {
 			unique = append(unique, s)
 		}
 	}
-	return unique
+	return unique
+}
+
+func contains(arr []string, str string) bool {
+	for _, a := range arr {
+		if a == str {
+			return true
+		}
+	}
+	return false
+}
+
+type CreateBookmarkPayload struct {
+	URL             string   `json:"url"`
+	Title           string   `json:"title"`
+	Description     string   `json:"description"`
+	Notes           string   `json:"notes"`
+	PreviewImageURL string   `json:"preview_image_url,omitempty"`
+	List            string   `json:"list,omitempty"`
+	IsArchived      bool     `json:"is_archived"`
+	Unread          bool     `json:"unread"`
+	Shared          bool     `json:"shared"`
+	TagNames        []string `json:"tag_names"`
+}
+
+// UpdateBookmarkPayload holds the fields to change with a PATCH, nil fields are left as is
+type UpdateBookmarkPayload struct {
+	Title       *string  `json:"title,omitempty"`
+	Description *string  `json:"description,omitempty"`
+	IsArchived  *bool    `json:"is_archived,omitempty"`
+	Unread      *bool    `json:"unread,omitempty"`
+	TagNames    []string `json:"tag_names,omitempty"`
+}
+
+type Bookmark struct {
+	ID           int       `json:"id"`
+	URL          string    `json:"url"`
+	Title        string    `json:"title"`
+	Description  string    `json:"description"`
+	Notes        string    `json:"notes"`
+	IsArchived   bool      `json:"is_archived"`
+	Unread       bool      `json:"unread"`
+	Shared       bool      `json:"shared"`
+	TagNames     []string  `json:"tag_names"`
+	DateAdded    time.Time `json:"date_added"`
+	DateModified time.Time `json:"date_modified"`
+}
+
+type checkBookmarkResponse struct {
+	Bookmark *Bookmark `json:"bookmark"`
+}
+
+// BookmarkPage is a page of a bookmark list, Next is empty on the last page
+type BookmarkPage struct {
+	Count   int         `json:"count"`
+	Next    string      `json:"next"`
+	Results []*Bookmark `json:"results"`
+}
+
+type LinkdingRepository interface {
+	CreateBookmark(ctx context.Context, payload *CreateBookmarkPayload) (*Bookmark, error)
+	// CheckBookmark returns the bookmark with the URL or nil if it isn't bookmarked
+	CheckBookmark(ctx context.Context, url string) (*Bookmark, error)
+	UpdateBookmark(ctx context.Context, id int, payload *UpdateBookmarkPayload) (*Bookmark, error)
+	DeleteBookmark(ctx context.Context, id int) error
+	// GetBookmarks returns a page of the unarchived or archived bookmarks matching the search query, e.g. "#tag",
+	// or of all of them when the query is empty
+	GetBookmarks(ctx context.Context, archived bool, query string, offset, limit int) (*BookmarkPage, error)
+	// SetApiToken replaces the token for the following requests, e.g. after it was rotated
+	SetApiToken(apiToken string)
+}
+
+// PropertyStatus is attached to errors caused by an unexpected linkding response status
+var PropertyStatus = errorx.RegisterPrintableProperty("status")
+
+// PropertyResponseSnippet holds the start of the unexpected linkding response, it isn't printed as the whole
+// response is logged anyway
+var PropertyResponseSnippet = errorx.RegisterProperty("response_snippet")
+
+const responseSnippetMaxLength = 200
+
+// responseSnippet returns the start of the response body, cut between runes
+func responseSnippet(body []byte) string {
+	snippet := strings.TrimSpace(string(body))
+	if runes := []rune(snippet); len(runes) > responseSnippetMaxLength {
+		snippet = string(runes[:responseSnippetMaxLength]) + "…"
+	}
+	return snippet
+}
+
+var (
+	RepositoryErrors = errorx.NewNamespace("linkding")
+	BookmarkExists   = RepositoryErrors.NewType("bookmark_exists", errorx.Duplicate())
+	// LinkdingUnavailable is returned when linkding can't be reached or is overloaded, trying again may help
+	LinkdingUnavailable = RepositoryErrors.NewType("unavailable", errorx.Temporary())
+	// LinkdingRejected is returned when linkding refuses the request, trying again won't help
+	LinkdingRejected = RepositoryErrors.NewType("rejected")
+)
+
+// statusErrorType returns the error type for an unexpected response status, server errors and rate limiting
+// are temporary
+func statusErrorType(status int) *errorx.Type {
+	if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+		return LinkdingUnavailable
+	}
+	return LinkdingRejected
+}
+
+type linkdingRepository struct {
+	baseUrl string
+	// apiToken is swapped on reload while requests are in flight, each request reads it once
+	apiToken  atomic.Pointer[string]
+	client    *http.Client
+	options   LinkdingRepositoryOptions
+	errorLogs *errorLogLimiter
+}
+
+func (l *linkdingRepository) newRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	fullPath, err := url.JoinPath(l.baseUrl, path)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to join path")
+	}
+	if len(query) > 0 {
+		fullPath += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fullPath, body)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to create request")
+	}
+
+	req.Header.Set("Content-Type", ApplicationJson)
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", *l.apiToken.Load()))
+	// extra headers go last, so Authorization is only replaced when it's configured explicitly
+	for key, values := range l.options.ExtraHeaders {
+		req.Header[key] = values
+	}
+	return req, nil
+}
+
+// do sends the payload (if any) as JSON, checks the response status and decodes the response into result (if any)
+func (l *linkdingRepository) do(ctx context.Context, method, path string, query url.Values, payload interface{}, expectedStatus int, result interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return errorx.Decorate(err, "failed to marshal payload")
+		}
+	}
+
+	req, err := l.newRequest(ctx, method, path, query, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	logger := loggerFrom(ctx)
+	// request and response bodies hold the bookmarked URLs
+	logBody := func(body []byte) []byte {
+		if l.options.RedactUrlsInLogs {
+			return []byte("[redacted]")
+		}
+		return body
+	}
+	logger.WithFields(log.Fields{
+		"method":  req.Method,
+		"url":     logUrl(req.URL.String(), l.options.RedactUrlsInLogs),
+		"headers": redactHeaders(req.Header, l.options.ExtraHeaders),
+	}).Tracef("Linkding request: %s", logBody(body))
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return LinkdingUnavailable.Wrap(redactUrlError(err, l.options.RedactUrlsInLogs), "failed to send request")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errorx.Decorate(err, "failed to read response body")
+	}
+	logger.WithField("status", resp.StatusCode).Tracef("Linkding response: %s", logBody(respBody))
+	l.logRateLimit(logger, req, resp.Header)
+
+	if resp.StatusCode != expectedStatus {
+		// the same error is returned for every save while linkding is down, which would flood the logs
+		key := fmt.Sprintf("%s %s %d", req.Method, path, resp.StatusCode)
+		if allowed, suppressed := l.errorLogs.Allow(key); allowed && suppressed > 0 {
+			logger.Printf("%s (suppressed %d similar)", logBody(respBody), suppressed)
+		} else if allowed {
+			logger.Printf("%s", logBody(respBody))
+		}
+		return statusErrorType(resp.StatusCode).New("unexpected status code %d", resp.StatusCode).
+			WithProperty(PropertyStatus, resp.StatusCode).
+			WithProperty(PropertyResponseSnippet, responseSnippet(respBody))
+	}
+
+	if result != nil {
+		if err = json.Unmarshal(respBody, result); err != nil {
+			return errorx.Decorate(err, "failed to unmarshal response")
+		}
+	}
+	return nil
+}
+
+func (l *linkdingRepository) CreateBookmark(ctx context.Context, payload *CreateBookmarkPayload) (*Bookmark, error) {
+	bookmark := &Bookmark{}
+	err := l.do(ctx, "POST", l.options.BookmarksPath, nil, payload, http.StatusCreated, bookmark)
+	if status, _ := errorx.ExtractProperty(err, PropertyStatus); status == http.StatusConflict {
+		return nil, BookmarkExists.Wrap(err, "bookmark for %s already exists", logUrl(payload.URL, l.options.RedactUrlsInLogs))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bookmark, nil
+}
+
+func (l *linkdingRepository) CheckBookmark(ctx context.Context, bookmarkUrl string) (*Bookmark, error) {
+	query := url.Values{"url": {bookmarkUrl}}
+	response := &checkBookmarkResponse{}
+	if err := l.do(ctx, "GET", l.options.BookmarksPath+"check/", query, nil, http.StatusOK, response); err != nil {
+		return nil, err
+	}
+	return response.Bookmark, nil
+}
+
+func (l *linkdingRepository) UpdateBookmark(ctx context.Context, id int, payload *UpdateBookmarkPayload) (*Bookmark, error) {
+	bookmark := &Bookmark{}
+	path := fmt.Sprintf("%s%d/", l.options.BookmarksPath, id)
+	if err := l.do(ctx, "PATCH", path, nil, payload, http.StatusOK, bookmark); err != nil {
+		return nil, err
+	}
+	return bookmark, nil
+}
+
+func (l *linkdingRepository) DeleteBookmark(ctx context.Context, id int) error {
+	return l.do(ctx, "DELETE", fmt.Sprintf("%s%d/", l.options.BookmarksPath, id), nil, nil, http.StatusNoContent, nil)
+}
+
+func (l *linkdingRepository) GetBookmarks(
+	ctx context.Context,
+	archived bool,
+	search string,
+	offset, limit int,
+) (*BookmarkPage, error) {
+	path := l.options.BookmarksPath
+	if archived {
+		path += "archived/"
+	}
+	query := url.Values{"offset": {strconv.Itoa(offset)}, "limit": {strconv.Itoa(limit)}}
+	if search != "" {
+		query.Set("q", search)
+	}
+	page := &BookmarkPage{}
+	if err := l.do(ctx, "GET", path, query, nil, http.StatusOK, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// waitForLinkding checks that linkding answers, retrying with backoff until the timeout. Errors that aren't
+// temporary, e.g. a wrong API token, fail right away
+func waitForLinkding(repository LinkdingRepository, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		_, err := repository.GetBookmarks(context.Background(), false, "", 0, 1)
+		if err == nil {
+			return nil
+		}
+		if !errorx.HasTrait(err, errorx.Temporary()) {
+			return errorx.Decorate(err, "linkding health check failed")
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return errorx.Decorate(err, "linkding isn't available after %s", timeout)
+		}
+		log.Printf("Waiting for linkding, attempt %d failed, retrying in %s: %v", attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// redactHeaders returns a copy of the headers that is safe to log. The extra headers are redacted too, they often
+// hold the credentials of a proxy in front of linkding
+func redactHeaders(headers http.Header, extraHeaders http.Header) http.Header {
+	redacted := headers.Clone()
+	if redacted.Get("Authorization") != "" {
+		redacted.Set("Authorization", "REDACTED")
+	}
+	for name := range extraHeaders {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, "REDACTED")
+		}
+	}
+	return redacted
+}
+
+// logRateLimit logs the rate limit headers linkding or a proxy in front of it sent, if any
+func (l *linkdingRepository) logRateLimit(logger *log.Entry, req *http.Request, headers http.Header) {
+	fields := log.Fields{}
+	for _, name := range l.options.RateLimitHeaders {
+		if value := headers.Get(name); value != "" {
+			fields[name] = value
+		}
+	}
+	if len(fields) > 0 {
+		logger.WithFields(fields).Debugf("Linkding rate limit after %s %s", req.Method, req.URL.Path)
+	}
+}
+
+// DefaultRateLimitHeaders are the de facto standard rate limit headers
+var DefaultRateLimitHeaders = []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After"}
+
+// DefaultBookmarksPath is where linkding serves its bookmarks API, relative to the base URL
+const DefaultBookmarksPath = "api/bookmarks/"
+
+// LinkdingRepositoryOptions configures how the linkding API is called
+type LinkdingRepositoryOptions struct {
+	// ExtraHeaders are sent with every request, e.g. for an authenticating proxy
+	ExtraHeaders http.Header
+	// RateLimitHeaders are the response headers logged to monitor rate limiting
+	RateLimitHeaders []string
+	// BookmarksPath is the bookmarks API path for forks or future versions, DefaultBookmarksPath when empty
+	BookmarksPath string
+	// ErrorLogWindow is how long repeated identical error responses are only counted instead of logged, every
+	// one is logged when zero
+	ErrorLogWindow time.Duration
+	// RedactUrlsInLogs logs only the host of URLs, see logUrl
+	RedactUrlsInLogs bool
+}
+
+// DefaultErrorLogWindow logs an outage about once a minute
+const DefaultErrorLogWindow = time.Minute
+
+func NewLinkdingRepository(
+	baseUrl, apiToken string,
+	client *http.Client,
+	options LinkdingRepositoryOptions,
+) LinkdingRepository {
+	if options.BookmarksPath == "" {
+		options.BookmarksPath = DefaultBookmarksPath
+	}
+	if !strings.HasSuffix(options.BookmarksPath, "/") {
+		options.BookmarksPath += "/"
+	}
+	repository := &linkdingRepository{
+		baseUrl:   baseUrl,
+		client:    client,
+		options:   options,
+		errorLogs: newErrorLogLimiter(options.ErrorLogWindow),
+	}
+	repository.SetApiToken(apiToken)
+	return repository
+}
+
+func (l *linkdingRepository) SetApiToken(apiToken string) {
+	l.apiToken.Store(&apiToken)
+}
+
+// TransportOptions tunes connection handling of the outbound HTTP clients, zero values keep the Go defaults
+type TransportOptions struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	DisableKeepAlives     bool
+	ResponseHeaderTimeout time.Duration
+	BlockPrivateIps       bool
+	Timeout               time.Duration
+	IpPreference          string
+	TlsMinVersion         uint16
+	TlsCipherSuites       []uint16
+	// Proxy replaces the proxy from the environment, nil keeps it
+	Proxy *url.URL
+	// MaxRedirects fails requests redirected more often, zero keeps Go's limit of 10
+	MaxRedirects int
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// DefaultTlsMinVersion leaves out the TLS versions with known weaknesses
+const DefaultTlsMinVersion = "1.2"
+
+// parseTlsVersion parses a TLS version like "1.2"
+func parseTlsVersion(version string) (uint16, error) {
+	parsed, found := tlsVersions[strings.TrimSpace(version)]
+	if !found {
+		return 0, errorx.IllegalArgument.New("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return parsed, nil
+}
+
+// parseTlsCipherSuites parses cipher suite names like "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Only the suites
+// Go considers secure are accepted, and they only apply up to TLS 1.2 as TLS 1.3 suites aren't configurable
+func parseTlsCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		// nil keeps Go's defaults, an empty list would allow no suite at all
+		return nil, nil
+	}
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		var id uint16
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				id = suite.ID
+			}
+		}
+		if id == 0 {
+			return nil, errorx.IllegalArgument.New("unknown or insecure TLS cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// Connection pool defaults. Go keeps only 2 idle connections per host, which makes linkding calls of a busy bot
+// reconnect all the time
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 10
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// IP preferences restrict dialing to one address family, e.g. for networks with broken IPv6. An empty preference
+// is the same as auto
+const (
+	IpPreferenceAuto = "auto"
+	IpPreferenceIpv4 = "ipv4"
+	IpPreferenceIpv6 = "ipv6"
+)
+
+type dialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dialWithIpPreference narrows TCP dials to the preferred address family, auto leaves the choice to the dialer
+func dialWithIpPreference(dial dialContextFunc, preference string) dialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if network == "tcp" {
+			switch preference {
+			case IpPreferenceIpv4:
+				network = "tcp4"
+			case IpPreferenceIpv6:
+				network = "tcp6"
+			}
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+func NewHttpClient(options TransportOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.Proxy != nil {
+		transport.Proxy = http.ProxyURL(options.Proxy)
+		// only the proxy is dialed, which is commonly a local one like Tor, while the target is resolved
+		// and connected to by the proxy itself
+		options.BlockPrivateIps = false
+	}
+	if options.BlockPrivateIps || options.IpPreference == IpPreferenceIpv4 || options.IpPreference == IpPreferenceIpv6 {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		if options.BlockPrivateIps {
+			dialer.Control = blockPrivateIps
+		}
+		transport.DialContext = dialWithIpPreference(dialer.DialContext, options.IpPreference)
+	}
+	if options.MaxIdleConns > 0 {
+		transport.MaxIdleConns = options.MaxIdleConns
+	}
+	if options.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+	if options.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = options.IdleConnTimeout
+	}
+	transport.DisableKeepAlives = options.DisableKeepAlives
+	transport.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion:   options.TlsMinVersion,
+		CipherSuites: options.TlsCipherSuites,
+	}
+	client := &http.Client{Transport: transport, Timeout: options.Timeout}
+	if options.MaxRedirects > 0 {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) > options.MaxRedirects {
+				return errorx.RejectedOperation.New("stopped after %d redirects", options.MaxRedirects)
+			}
+			return nil
+		}
+	}
+	return client
+}
+
+// sharedAddressSpace is the carrier-grade NAT range 100.64.0.0/10, which net.IP.IsPrivate doesn't cover
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// blockPrivateIps is a net.Dialer control function rejecting non-public addresses. It runs after DNS resolution,
+// so hosts resolving (or rebinding) to internal addresses are caught as well
+func blockPrivateIps(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errorx.Decorate(err, "failed to parse dial address")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errorx.IllegalArgument.New("dial address %s is not an IP", address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return errorx.RejectedOperation.New("refusing to connect to non-public address %s", ip)
+	}
+	return nil
+}
+
+// proxySchemes are the proxy URL schemes supported by http.Transport
+var proxySchemes = []string{"http", "https", "socks5"}
+
+// parseProxyUrl parses a proxy URL like "socks5://127.0.0.1:9050", an empty one is nil
+func parseProxyUrl(proxyUrl string) (*url.URL, error) {
+	if proxyUrl == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to parse proxy URL")
+	}
+	if !contains(proxySchemes, parsed.Scheme) || parsed.Host == "" {
+		return nil, errorx.IllegalArgument.New("proxy URL must be like socks5://host:port, supported schemes are %v",
+			proxySchemes)
+	}
+	return parsed, nil
+}
+
+// parseHeaders parses a list of "Key:Value" entries into HTTP headers
+func parseHeaders(entries []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, entry := range entries {
+		key, value, found := strings.Cut(entry, ":")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, errorx.IllegalArgument.New("invalid header %q, expected Key:Value", entry)
+		}
+		headers.Add(key, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// hostOf returns the lowercased host of the URL or an empty string if it can't be parsed
+func hostOf(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+// matchesDomain reports whether the host matches any of the domains. "example.com" matches only the domain
+// itself, "*.example.com" matches the domain and all of its subdomains
+func matchesDomain(host string, domains []string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if parent, isWildcard := strings.CutPrefix(domain, "*."); isWildcard {
+			if host == parent || strings.HasSuffix(host, "."+parent) {
+				return true
+			}
+		} else if host == domain {
+			return true
+		}
+	}
+	return false
+}
+
+type PageInfo struct {
+	url         string
+	title       string
+	description string
+	text        string
+	imageUrl    string
+	siteName    string
+	author      string
+}
+
+type PageInfoService interface {
+	GetPageInfo(ctx context.Context, url string) (*PageInfo, error)
+}
+
+const (
+	DefaultPageTextMaxLength = 10000
+	// pageTextMinLength is the shortest main content considered an article rather than e.g. a landing page
+	pageTextMinLength = 200
+	// pageMaxBytes caps how much of a page is read, a huge or endless response would otherwise be parsed in memory
+	pageMaxBytes = 5 << 20
+)
+
+// PageInfoServiceOptions configures how pages are fetched and what is extracted from them
+type PageInfoServiceOptions struct {
+	// DomainDelay is the minimum time between fetches from the same host
+	DomainDelay time.Duration
+	// ExtractText enables readability extraction of the main page text
+	ExtractText bool
+	// TextMaxLength is the length in runes the extracted text is truncated to
+	TextMaxLength int
+	// ExtractPreviewImage picks the Open Graph image of the page as the bookmark preview
+	ExtractPreviewImage bool
+	// Timeout limits the whole fetch of a page unless a fetch override sets its own, there's no limit when zero
+	Timeout time.Duration
+	// FetchOverrides change how pages from particular domains are fetched, the first matching one applies
+	FetchOverrides []FetchOverride
+	// RedactUrlsInLogs logs only the host of URLs, see logUrl
+	RedactUrlsInLogs bool
+}
+
+// FetchOverride changes how pages from the matching domains are fetched
+type FetchOverride struct {
+	// Domain is matched against the page host, see matchesDomain for the syntax
+	Domain string
+	// Timeout limits the whole fetch instead of the default fetch timeout
+	Timeout time.Duration
+	// SkipFetch saves pages without fetching them, titled after their URL
+	SkipFetch bool
+}
+
+// parseFetchOverrides parses a list of "domain=timeout" and "domain=skip" entries, e.g. "*.example.com=30s"
+func parseFetchOverrides(entries []string) ([]FetchOverride, error) {
+	overrides := make([]FetchOverride, 0, len(entries))
+	for _, entry := range entries {
+		domain, value, found := strings.Cut(entry, "=")
+		domain = strings.TrimSpace(domain)
+		value = strings.TrimSpace(value)
+		if !found || domain == "" {
+			return nil, errorx.IllegalArgument.New("invalid fetch override %q, expected domain=timeout or domain=skip", entry)
+		}
+		override := FetchOverride{Domain: domain}
+		if value == "skip" {
+			override.SkipFetch = true
+		} else {
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return nil, errorx.IllegalArgument.New("invalid fetch override %q, timeout must be a positive duration", entry)
+			}
+			override.Timeout = timeout
+		}
+		overrides = append(overrides, override)
+	}
+	return overrides, nil
+}
+
+type pageInfoService struct {
+	client    *http.Client
+	options   PageInfoServiceOptions
+	mu        sync.Mutex
+	nextFetch map[string]time.Time
+}
+
+func NewPageInfoService(client *http.Client, options PageInfoServiceOptions) PageInfoService {
+	if options.TextMaxLength <= 0 {
+		options.TextMaxLength = DefaultPageTextMaxLength
+	}
+	return &pageInfoService{
+		client:    client,
+		options:   options,
+		nextFetch: make(map[string]time.Time),
+	}
+}
+
+// waitForDomain blocks until the host may be fetched again or the context is done. Only fetches from the same host
+// wait for each other
+func (p *pageInfoService) waitForDomain(ctx context.Context, host string) error {
+	if p.options.DomainDelay <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	fetchAt := now
+	if next, found := p.nextFetch[host]; found && next.After(now) {
+		fetchAt = next
+	}
+	p.nextFetch[host] = fetchAt.Add(p.options.DomainDelay)
+	for key, next := range p.nextFetch {
+		if next.Before(now) {
+			delete(p.nextFetch, key)
+		}
+	}
+	p.mu.Unlock()
+
+	wait := fetchAt.Sub(now)
+	if wait <= 0 {
+		return nil
+	}
+	loggerFrom(ctx).Debugf("Waiting %s before fetching from %s", wait, host)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchOverride returns the first override matching the host or nil
+func (p *pageInfoService) fetchOverride(host string) *FetchOverride {
+	for i := range p.options.FetchOverrides {
+		if matchesDomain(host, []string{p.options.FetchOverrides[i].Domain}) {
+			return &p.options.FetchOverrides[i]
+		}
+	}
+	return nil
+}
+
+func (p *pageInfoService) GetPageInfo(ctx context.Context, url string) (*PageInfo, error) {
+	host := hostOf(url)
+	timeout := p.options.Timeout
+	if override := p.fetchOverride(host); override != nil {
+		if override.SkipFetch {
+			loggerFrom(ctx).Debugf("Skipping fetch of %s", logUrl(url, p.options.RedactUrlsInLogs))
+			return &PageInfo{url: url, title: titleFromUrl(url)}, nil
+		}
+		timeout = override.Timeout
+	}
+
+	// the timeout only starts once it's the fetch's turn, waiting for the domain doesn't eat into it
+	if err := p.waitForDomain(ctx, host); err != nil {
+		return nil, errorx.Decorate(err, "gave up waiting to fetch from %s", host)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to create request")
+	}
+	resp, err := p.client.Do(req)
+	// refused dials and redirects come wrapped in *url.Error, unwrapped so callers can tell them by their type
+	var rejected *errorx.Error
+	if errors.As(err, &rejected) && rejected.IsOfType(errorx.RejectedOperation) {
+		return nil, errorx.Decorate(rejected, "failed to fetch URL")
+	}
+	if err != nil {
+		return nil, errorx.Decorate(redactUrlError(err, p.options.RedactUrlsInLogs), "failed to fetch URL")
+	}
+	defer resp.Body.Close()
+	// error pages would be saved with titles like "502 Bad Gateway"
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, errorx.ExternalError.New("page responded with status %d", resp.StatusCode)
+	}
+
+	info := htmlinfo.NewHTMLInfo()
+	// oembed endpoints are fetched through the same client, so they get the same private IP blocking, proxy,
+	// TLS and redirect settings as the page itself
+	info.Client = p.client
+	info.AllowOembedFetching = true
+	info.AllowMainContentExtraction = p.options.ExtractText
+
+	// transcode to UTF-8 using the charset from Content-Type, a BOM or <meta charset>, otherwise titles in
+	// e.g. windows-1251 end up as mojibake
+	body, err := charset.NewReader(io.LimitReader(resp.Body, pageMaxBytes), resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to detect page charset")
+	}
+
+	ct := "text/html; charset=utf-8"
+	if err = info.Parse(body, &url, &ct); err != nil {
+		return nil, errorx.Decorate(err, "failed to parse page info")
+	}
+
+	oembed := info.GenerateOembedFor(url)
+	output := &PageInfo{
+		url: url,
+	}
+	if oembed != nil {
+		output.title = oembed.Title
+		output.description = oembed.Description
+		output.siteName = oembed.ProviderName
+		output.author = oembed.AuthorName
+	} else {
+		output.title = info.Title
+		output.description = info.Description
+	}
+	if output.siteName == "" && info.OGInfo != nil {
+		output.siteName = info.OGInfo.SiteName
+	}
+	// the generated oembed has no author unless the page has an oembed endpoint, <meta name="author"> is parsed anyway
+	if output.author == "" {
+		output.author = info.AuthorName
+	}
+	if p.options.ExtractText {
+		output.text = pageText(info.MainContent, p.options.TextMaxLength)
+	}
+	if p.options.ExtractPreviewImage {
+		output.imageUrl = previewImageUrl(info)
+	}
+	return output, nil
+}
+
+// previewImageUrl returns the Open Graph image of the page, falling back to <link rel="image_src">
+func previewImageUrl(info *htmlinfo.HTMLInfo) string {
+	if info.OGInfo != nil {
+		for _, image := range info.OGInfo.Images {
+			if image != nil && image.URL != "" {
+				return image.URL
+			}
+		}
+	}
+	return info.ImageSrcURL
+}
+
+// titleFromUrl makes a title out of the URL's host and path for pages that aren't fetched or have no metadata
+func titleFromUrl(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	return parsed.Host + strings.TrimSuffix(parsed.Path, "/")
+}
+
+// pageText cleans up the extracted main content, returning an empty string for pages that aren't articles
+func pageText(content string, maxLength int) string {
+	content = strings.TrimSpace(content)
+	runes := []rune(content)
+	if len(runes) < pageTextMinLength {
+		return ""
+	}
+	if len(runes) > maxLength {
+		return string(runes[:maxLength-1]) + "…"
+	}
+	return content
+}
+
+type pageInfoCacheEntry struct {
+	pageInfo  *PageInfo
+	expiresAt time.Time
+}
+
+// cachingPageInfoService reuses page info fetched within the TTL instead of fetching the same URL again
+type cachingPageInfoService struct {
+	delegate PageInfoService
+	ttl      time.Duration
+	mu       sync.Mutex
+	entries  map[string]pageInfoCacheEntry
+}
+
+func NewCachingPageInfoService(delegate PageInfoService, ttl time.Duration) PageInfoService {
+	return &cachingPageInfoService{
+		delegate: delegate,
+		ttl:      ttl,
+		entries:  make(map[string]pageInfoCacheEntry),
+	}
+}
+
+type freshPageInfoKey struct{}
+
+// withFreshPageInfo makes the caching page info service fetch the page again, e.g. to pick up fixed metadata
+func withFreshPageInfo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshPageInfoKey{}, true)
+}
+
+func (c *cachingPageInfoService) GetPageInfo(ctx context.Context, url string) (*PageInfo, error) {
+	c.mu.Lock()
+	entry, found := c.entries[url]
+	c.mu.Unlock()
+	fresh, _ := ctx.Value(freshPageInfoKey{}).(bool)
+	if found && !fresh && time.Now().Before(entry.expiresAt) {
+		// the URL is logged by the caller under the same correlation ID
+		loggerFrom(ctx).Debug("Page info cache hit")
+		pageInfo := *entry.pageInfo
+		return &pageInfo, nil
+	}
+
+	pageInfo, err := c.delegate.GetPageInfo(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	cached := *pageInfo
+	c.entries[url] = pageInfoCacheEntry{&cached, now.Add(c.ttl)}
+	return pageInfo, nil
+}
+
+// SaveOptions holds per-message adjustments applied to the saved bookmark
+type SaveOptions struct {
+	TagNames   []string
+	IsArchived bool
+	// MarkRead saves the bookmark as read, bookmarks are unread by default
+	MarkRead bool
+	Shared   bool
+	// Notes are appended to the notes of the bookmark
+	Notes string
+	// List is the list the bookmark is saved to instead of the default target list
+	List string
+	// Description replaces the description fetched from the page when set
+	Description string
+	// SkipFetch saves the bookmark without fetching the page, e.g. for pages known to be slow
+	SkipFetch bool
+	// ForceUnread saves the bookmark unread and not archived, overriding AutoArchiveDomains and ReadDomains
+	ForceUnread bool
+}
+
+type LinkService interface {
+	Save(ctx context.Context, url string, options *SaveOptions) (*Bookmark, error)
+	// SaveNote saves text without a link as a bookmark with the text in its notes
+	SaveNote(ctx context.Context, placeholderUrl, text string, options *SaveOptions) (*Bookmark, error)
+	ToggleArchived(ctx context.Context, url string) (*Bookmark, error)
+	ToggleUnread(ctx context.Context, url string) (*Bookmark, error)
+	Delete(ctx context.Context, id int) error
+	// DeleteByUrl deletes the bookmark of the URL, failing with BookmarkNotFound if there is none
+	DeleteByUrl(ctx context.Context, url string) error
+	// Refresh fetches the page again and updates the title and description of the URL's bookmark, failing with
+	// BookmarkNotFound if there is none
+	Refresh(ctx context.Context, url string) (*Bookmark, error)
+	// ForEachBookmark calls fn with every bookmark, archived ones included, stopping at the first error
+	ForEachBookmark(ctx context.Context, fn func(bookmark *Bookmark) error) error
+	// ArchiveStale archives the unread bookmarks with the tag added before the cutoff and returns how many it archived
+	ArchiveStale(ctx context.Context, tag string, cutoff time.Time) (int, error)
+}
+
+// PropertyUrl is attached to errors returned by Save, so the URL that failed ends up in the logs
+var PropertyUrl = errorx.RegisterPrintableProperty("url")
+
+var (
+	LinkErrors       = errorx.NewNamespace("link")
+	BookmarkNotFound = LinkErrors.NewType("bookmark_not_found", errorx.NotFound())
+	UrlTooLong       = LinkErrors.NewType("url_too_long")
+)
+
+// DefaultMaxUrlLength is generous enough for any sane link while keeping malformed ones away from linkding
+const DefaultMaxUrlLength = 2048
+
+// LinkServiceOptions holds the bookmark defaults applied by the link service
+type LinkServiceOptions struct {
+	// AutoArchiveDomains are domains whose bookmarks are archived right away, see matchesDomain for the syntax
+	AutoArchiveDomains []string
+	// ReadDomains are domains whose bookmarks are saved as read, see matchesDomain for the syntax
+	ReadDomains []string
+	// MaxUrlLength rejects longer URLs with UrlTooLong, there's no limit when zero
+	MaxUrlLength int
+	// SaveOnFetchFailure saves the bookmark without page info when the page can't be fetched
+	SaveOnFetchFailure bool
+	// TargetList is sent as the list of every bookmark for linkding versions supporting lists, older versions
+	// ignore it. Nothing is sent when empty
+	TargetList string
+	// TitleStripSuffixes are separators like " | " after whose last occurrence the site name is cut off titles
+	TitleStripSuffixes []string
+	// FetchFailureTag is added to bookmarks saved without page info, so they can be found and fixed later
+	FetchFailureTag string
+	// LinkdingScrapeFallback saves bookmarks without title and description when the page can't be fetched or has
+	// no title, so linkding fetches them instead. It takes precedence over TitleFromUrlFallback
+	LinkdingScrapeFallback bool
+	// TitleFromUrlFallback titles bookmarks of pages without a title and description after the URL's host and path,
+	// as linkding would only show the bare URL
+	TitleFromUrlFallback bool
+	// SourceNote adds the site name and author of the page to the notes
+	SourceNote bool
+	// RelayTag is added to every bookmark the relay saves, so its own bookmarks can be told apart later
+	RelayTag string
+	// UrlNormalization is applied to the URLs before they are saved or looked up
+	UrlNormalization UrlNormalization
+	// RedactUrlsInLogs logs only the host of URLs, see logUrl
+	RedactUrlsInLogs bool
+}
+
+type linkdingLinkService struct {
+	repository      LinkdingRepository
+	pageInfoService PageInfoService
+	options         LinkServiceOptions
+}
+
+func NewLinkdingLinkService(
+	repository LinkdingRepository,
+	pageInfoService PageInfoService,
+	options LinkServiceOptions,
+) LinkService {
+	return &linkdingLinkService{repository, pageInfoService, options}
+}
+
+func (l *linkdingLinkService) Save(ctx context.Context, url string, options *SaveOptions) (bookmark *Bookmark, err error) {
+	if options == nil {
+		options = &SaveOptions{}
+	}
+	defer func() {
+		if err != nil {
+			err = errorx.Decorate(err, "failed to save URL").WithProperty(PropertyUrl, logUrl(url, l.options.RedactUrlsInLogs))
+		}
+	}()
+
+	logger := loggerFrom(ctx).WithField("url", logUrl(url, l.options.RedactUrlsInLogs))
+	logger.Debug("Saving url")
+
+	if l.options.MaxUrlLength > 0 && len(url) > l.options.MaxUrlLength {
+		return nil, UrlTooLong.New("URL is %d bytes long, the limit is %d", len(url), l.options.MaxUrlLength)
+	}
+
+	normalizedUrl, err := normalizeUrl(url, l.options.UrlNormalization)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to normalize URL")
+	}
+	logger.Debugf("Normalized URL: %s", logUrl(normalizedUrl, l.options.RedactUrlsInLogs))
+
+	fromTime := time.Now()
+	var pageInfo *PageInfo
+	if options.SkipFetch {
+		logger.Debug("Skipping page info fetch")
+		pageInfo = &PageInfo{url: normalizedUrl}
+	} else if !isValidUrl(normalizedUrl, DefaultAllowedSchemes) {
+		// links with other schemes allowed by ALLOWED_SCHEMES, e.g. ftp://, are saved but there's no page to fetch
+		logger.Debug("Skipping page info fetch of a URL that isn't http or https")
+		pageInfo = &PageInfo{url: normalizedUrl}
+	} else {
+		pageInfo, err = l.pageInfoService.GetPageInfo(ctx, normalizedUrl)
+	}
+	fetchFailed := err != nil
+	if fetchFailed && !l.options.SaveOnFetchFailure && !l.options.LinkdingScrapeFallback {
+		return nil, errorx.Decorate(err, "failed to get page info")
+	}
+	if fetchFailed {
+		logger.Warnf("Saving without page info: %+v", err)
+		pageInfo = &PageInfo{url: normalizedUrl}
+	}
+	toTime := time.Now()
+	logger.Debugf("Completed page info fetch in %s", toTime.Sub(fromTime))
+
+	payload := newCreateBookmarkPayload(normalizedUrl, options)
+	if payload.List == "" {
+		payload.List = l.options.TargetList
+	}
+	if l.options.RelayTag != "" {
+		payload.TagNames = distinct(append(payload.TagNames, l.options.RelayTag))
+	}
+	if fetchFailed && l.options.FetchFailureTag != "" {
+		payload.TagNames = distinct(append(payload.TagNames, l.options.FetchFailureTag))
+	}
+	payload.Title = stripTitleSuffix(pageInfo.title, l.options.TitleStripSuffixes)
+	payload.Description = pageInfo.description
+	if options.Description != "" {
+		payload.Description = options.Description
+	}
+	// linkding scrapes the page itself when a bookmark is created without a title
+	leaveToLinkding := l.options.LinkdingScrapeFallback && (fetchFailed || payload.Title == "")
+	if leaveToLinkding {
+		logger.Debug("Leaving the metadata to linkding")
+		payload.Title, payload.Description = "", options.Description
+	}
+	if !leaveToLinkding && payload.Title == "" && payload.Description == "" && l.options.TitleFromUrlFallback {
+		payload.Title = titleFromUrl(normalizedUrl)
+	}
+	payload.Notes = joinNotes(pageInfo.text, options.Notes)
+	if l.options.SourceNote {
+		payload.Notes = joinNotes(sourceNote(pageInfo), payload.Notes)
+	}
+	payload.PreviewImageURL = pageInfo.imageUrl
+	if !options.ForceUnread && matchesDomain(hostOf(normalizedUrl), l.options.AutoArchiveDomains) {
+		logger.Debug("Archiving bookmark from an auto-archive domain")
+		payload.IsArchived = true
+	}
+	if !options.ForceUnread && matchesDomain(hostOf(normalizedUrl), l.options.ReadDomains) {
+		logger.Debug("Marking bookmark from a read domain as read")
+		payload.Unread = false
+	}
+
+	fromTime = time.Now()
+	bookmark, err = l.repository.CreateBookmark(ctx, &payload)
+	toTime = time.Now()
+	logger.WithField("error", err).Debugf("Completed bookmark creation in %s", toTime.Sub(fromTime))
+
+	return bookmark, err
+}
+
+func (l *linkdingLinkService) SaveNote(ctx context.Context, placeholderUrl, text string, options *SaveOptions) (*Bookmark, error) {
+	if options == nil {
+		options = &SaveOptions{}
+	}
+
+	loggerFrom(ctx).Debugf("Saving note under placeholder url: %s", logUrl(placeholderUrl, l.options.RedactUrlsInLogs))
+
+	payload := newCreateBookmarkPayload(placeholderUrl, options)
+	if payload.List == "" {
+		payload.List = l.options.TargetList
+	}
+	if l.options.RelayTag != "" {
+		payload.TagNames = distinct(append(payload.TagNames, l.options.RelayTag))
+	}
+	payload.Title = noteTitle(text)
+	payload.Notes = joinNotes(text, options.Notes)
+
+	return l.repository.CreateBookmark(ctx, &payload)
+}
+
+// findBookmark normalizes the URL and looks up its bookmark, failing with BookmarkNotFound if there is none
+func (l *linkdingLinkService) findBookmark(ctx context.Context, url string) (*Bookmark, error) {
+	normalizedUrl, err := normalizeUrl(url, l.options.UrlNormalization)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to normalize URL")
+	}
+
+	bookmark, err := l.repository.CheckBookmark(ctx, normalizedUrl)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to check bookmark")
+	}
+	if bookmark == nil {
+		return nil, BookmarkNotFound.New("no bookmark for %s", logUrl(normalizedUrl, l.options.RedactUrlsInLogs))
+	}
+	return bookmark, nil
+}
+
+func (l *linkdingLinkService) ToggleArchived(ctx context.Context, url string) (*Bookmark, error) {
+	bookmark, err := l.findBookmark(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	isArchived := !bookmark.IsArchived
+	return l.repository.UpdateBookmark(ctx, bookmark.ID, &UpdateBookmarkPayload{IsArchived: &isArchived})
+}
+
+func (l *linkdingLinkService) ToggleUnread(ctx context.Context, url string) (*Bookmark, error) {
+	bookmark, err := l.findBookmark(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	unread := !bookmark.Unread
+	return l.repository.UpdateBookmark(ctx, bookmark.ID, &UpdateBookmarkPayload{Unread: &unread})
+}
+
+func (l *linkdingLinkService) Delete(ctx context.Context, id int) error {
+	loggerFrom(ctx).Debugf("Deleting bookmark %d", id)
+	return l.repository.DeleteBookmark(ctx, id)
+}
+
+func (l *linkdingLinkService) DeleteByUrl(ctx context.Context, url string) error {
+	bookmark, err := l.findBookmark(ctx, url)
+	if err != nil {
+		return err
+	}
+	return l.Delete(ctx, bookmark.ID)
+}
+
+func (l *linkdingLinkService) Refresh(ctx context.Context, url string) (*Bookmark, error) {
+	bookmark, err := l.findBookmark(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	pageInfo, err := l.pageInfoService.GetPageInfo(withFreshPageInfo(ctx), bookmark.URL)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to get page info")
+	}
+
+	// metadata missing from the page keeps the current one rather than clearing it
+	payload := &UpdateBookmarkPayload{}
+	if title := stripTitleSuffix(pageInfo.title, l.options.TitleStripSuffixes); title != "" {
+		payload.Title = &title
+	}
+	if pageInfo.description != "" {
+		payload.Description = &pageInfo.description
+	}
+	if payload.Title == nil && payload.Description == nil {
+		loggerFrom(ctx).WithField("url", logUrl(bookmark.URL, l.options.RedactUrlsInLogs)).
+			Debug("No metadata to refresh the bookmark with")
+		return bookmark, nil
+	}
+	return l.repository.UpdateBookmark(ctx, bookmark.ID, payload)
+}
+
+// stripTitleSuffix cuts the title at the last occurrence of any of the separators, e.g. "Post | Blog" becomes
+// "Post". Titles that would end up empty are kept as is
+func stripTitleSuffix(title string, separators []string) string {
+	cut := -1
+	for _, separator := range separators {
+		if separator == "" {
+			continue
+		}
+		if i := strings.LastIndex(title, separator); i > cut {
+			cut = i
+		}
+	}
+	if cut <= 0 || strings.TrimSpace(title[:cut]) == "" {
+		return title
+	}
+	return strings.TrimSpace(title[:cut])
+}
+
+// sourceNote describes where the page comes from, e.g. "Site: GitHub, Author: octocat", empty if it's unknown
+func sourceNote(pageInfo *PageInfo) string {
+	parts := make([]string, 0, 2)
+	if pageInfo.siteName != "" {
+		parts = append(parts, "Site: "+pageInfo.siteName)
+	}
+	if pageInfo.author != "" {
+		parts = append(parts, "Author: "+pageInfo.author)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// joinNotes joins the non-empty notes with a blank line
+func joinNotes(notes ...string) string {
+	nonEmpty := make([]string, 0, len(notes))
+	for _, note := range notes {
+		if note != "" {
+			nonEmpty = append(nonEmpty, note)
+		}
+	}
+	return strings.Join(nonEmpty, "\n\n")
+}
+
+const bookmarkPageSize = 100
+
+func (l *linkdingLinkService) ForEachBookmark(ctx context.Context, fn func(bookmark *Bookmark) error) error {
+	for _, archived := range []bool{false, true} {
+		for offset := 0; ; offset += bookmarkPageSize {
+			page, err := l.repository.GetBookmarks(ctx, archived, "", offset, bookmarkPageSize)
+			if err != nil {
+				return errorx.Decorate(err, "failed to get bookmarks at offset %d", offset)
+			}
+			for _, bookmark := range page.Results {
+				if err = fn(bookmark); err != nil {
+					return err
+				}
+			}
+			if page.Next == "" || len(page.Results) == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// staleBookmarks selects the unread, unarchived bookmarks with the tag that were added before the cutoff
+func staleBookmarks(bookmarks []*Bookmark, tag string, cutoff time.Time) []*Bookmark {
+	stale := make([]*Bookmark, 0)
+	for _, bookmark := range bookmarks {
+		if bookmark.IsArchived || !bookmark.Unread || !bookmark.DateAdded.Before(cutoff) {
+			continue
+		}
+		if contains(bookmark.TagNames, tag) {
+			stale = append(stale, bookmark)
+		}
+	}
+	return stale
+}
+
+func (l *linkdingLinkService) ArchiveStale(ctx context.Context, tag string, cutoff time.Time) (int, error) {
+	// collected up front, archiving while paging would shift the offsets of the remaining bookmarks. linkding
+	// only returns the tagged ones, staleBookmarks still checks the tag in case the search matches more loosely
+	bookmarks := make([]*Bookmark, 0)
+	for offset := 0; ; offset += bookmarkPageSize {
+		page, err := l.repository.GetBookmarks(ctx, false, "#"+tag, offset, bookmarkPageSize)
+		if err != nil {
+			return 0, errorx.Decorate(err, "failed to get bookmarks at offset %d", offset)
+		}
+		bookmarks = append(bookmarks, page.Results...)
+		if page.Next == "" || len(page.Results) == 0 {
+			break
+		}
+	}
+	archived := 0
+	isArchived := true
+	for _, bookmark := range staleBookmarks(bookmarks, tag, cutoff) {
+		loggerFrom(ctx).Debugf("Archiving stale bookmark %d: %s", bookmark.ID, logUrl(bookmark.URL, l.options.RedactUrlsInLogs))
+		_, err := l.repository.UpdateBookmark(ctx, bookmark.ID, &UpdateBookmarkPayload{IsArchived: &isArchived})
+		if err != nil {
+			return archived, errorx.Decorate(err, "failed to archive bookmark %d", bookmark.ID)
+		}
+		archived++
+	}
+	return archived, nil
+}
+
+func newCreateBookmarkPayload(url string, options *SaveOptions) CreateBookmarkPayload {
+	return CreateBookmarkPayload{
+		URL:         url,
+		Title:       "",
+		Description: "",
+		Notes:       "",
+		IsArchived:  options.IsArchived,
+		Unread:      !options.MarkRead,
+		Shared:      options.Shared,
+		TagNames:    append([]string{}, options.TagNames...),
+		List:        options.List,
+	}
+}
+
+const noteTitleMaxLength = 100
+
+// noteTitle returns the first line of the text, shortened to noteTitleMaxLength runes
+func noteTitle(text string) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	if runes := []rune(title); len(runes) > noteTitleMaxLength {
+		title = string(runes[:noteTitleMaxLength-1]) + "…"
+	}
+	return title
+}
+
+var markdownV2Replacer = strings.NewReplacer(
+	"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)", "~", "\\~",
+	"`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=", "|", "\\|", "{", "\\{",
+	"}", "\\}", ".", "\\.", "!", "\\!",
+)
+
+// markdownV2UrlReplacer escapes the URL part of a MarkdownV2 inline link
+var markdownV2UrlReplacer = strings.NewReplacer("\\", "\\\\", ")", "\\)")
+
+// parseParseMode maps the configured reply parse mode, empty meaning plain text
+func parseParseMode(mode string) (echotron.ParseMode, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		return "", nil
+	case "html":
+		return echotron.HTML, nil
+	case "markdownv2":
+		return echotron.MarkdownV2, nil
+	default:
+		return "", errorx.IllegalArgument.New("unsupported parse mode %q, expected HTML or MarkdownV2", mode)
+	}
+}
+
+// escapeForParseMode escapes user-controlled text, so it can't break the formatting of a reply
+func escapeForParseMode(text string, mode echotron.ParseMode) string {
+	switch mode {
+	case echotron.HTML:
+		return html.EscapeString(text)
+	case echotron.MarkdownV2:
+		return markdownV2Replacer.Replace(text)
+	default:
+		return text
+	}
+}
+
+func formatLink(text, url string, mode echotron.ParseMode) string {
+	switch mode {
+	case echotron.HTML:
+		return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(url), html.EscapeString(text))
+	case echotron.MarkdownV2:
+		return fmt.Sprintf("[%s](%s)", markdownV2Replacer.Replace(text), markdownV2UrlReplacer.Replace(url))
+	default:
+		return fmt.Sprintf("%s (%s)", text, url)
+	}
+}
+
+type savedBookmark struct {
+	id  int
+	url string
+}
+
+// lastSavedKey identifies whose save is tracked. Users sharing a group undo only their own saves, messages without
+// a sender (e.g. channel posts) share the zero user ID
+type lastSavedKey struct {
+	chatId int64
+	userId int64
+}
+
+func newLastSavedKey(chatId int64, user *echotron.User) lastSavedKey {
+	key := lastSavedKey{chatId: chatId}
+	if user != nil {
+		key.userId = user.ID
+	}
+	return key
+}
+
+// lastSavedTracker remembers the last bookmark saved by each user in each chat for /undo. Updates are handled
+// concurrently, so all access goes through the mutex
+type lastSavedTracker struct {
+	mu      sync.Mutex
+	entries map[lastSavedKey]savedBookmark
+}
+
+func newLastSavedTracker() *lastSavedTracker {
+	return &lastSavedTracker{entries: make(map[lastSavedKey]savedBookmark)}
+}
+
+func (t *lastSavedTracker) Set(chatId int64, user *echotron.User, bookmark *Bookmark) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[newLastSavedKey(chatId, user)] = savedBookmark{bookmark.ID, bookmark.URL}
+}
+
+// Pop returns and forgets the last bookmark saved by the user in the chat
+func (t *lastSavedTracker) Pop(chatId int64, user *echotron.User) (savedBookmark, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := newLastSavedKey(chatId, user)
+	entry, found := t.entries[key]
+	delete(t.entries, key)
+	return entry, found
+}
+
+// nextTagsTracker holds the tags set with /nexttag, which only apply to the next link saved in the chat
+type nextTagsTracker struct {
+	mu      sync.Mutex
+	entries map[int64][]string
+}
+
+func newNextTagsTracker() *nextTagsTracker {
+	return &nextTagsTracker{entries: make(map[int64][]string)}
+}
+
+func (t *nextTagsTracker) Set(chatId int64, tags []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[chatId] = tags
+}
+
+// Pop returns and forgets the pending tags of the chat
+func (t *nextTagsTracker) Pop(chatId int64) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tags := t.entries[chatId]
+	delete(t.entries, chatId)
+	return tags
+}
+
+// recentSaves remembers the URLs saved in each chat for a while, so a link sent twice in a row isn't saved again
+type recentSaves struct {
+	mu            sync.Mutex
+	ttl           time.Duration
+	normalization UrlNormalization
+	entries       map[int64]map[string]time.Time
+}
+
+func newRecentSaves(ttl time.Duration, normalization UrlNormalization) *recentSaves {
+	return &recentSaves{ttl: ttl, normalization: normalization, entries: make(map[int64]map[string]time.Time)}
+}
+
+// Seen reports whether the URL was saved in the chat within the TTL, there's nothing to see when the TTL is zero
+func (r *recentSaves) Seen(chatId int64, url string) bool {
+	if r.ttl <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	savedAt, found := r.entries[chatId][urlDedupKey(url, r.normalization)]
+	return found && time.Since(savedAt) < r.ttl
+}
+
+func (r *recentSaves) Add(chatId int64, url string) {
+	if r.ttl <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	chatEntries, found := r.entries[chatId]
+	if !found {
+		chatEntries = make(map[string]time.Time)
+		r.entries[chatId] = chatEntries
+	}
+	for key, savedAt := range chatEntries {
+		if now.Sub(savedAt) >= r.ttl {
+			delete(chatEntries, key)
+		}
+	}
+	chatEntries[urlDedupKey(url, r.normalization)] = now
+}
+
+// Forget lets the URL be saved again right away, e.g. after the save was undone
+func (r *recentSaves) Forget(chatId int64, url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries[chatId], urlDedupKey(url, r.normalization))
+}
+
+// errorLogLimiter keeps repeated identical errors from flooding the logs: the first one is logged, the next ones
+// within the window are only counted and the count is logged with the first one after the window
+type errorLogLimiter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*suppressedErrors
+	// prunedAt is when the entries were last pruned, keys include bookmark IDs so they'd pile up otherwise
+	prunedAt time.Time
+}
+
+type suppressedErrors struct {
+	loggedAt time.Time
+	count    int
+}
+
+func newErrorLogLimiter(window time.Duration) *errorLogLimiter {
+	return &errorLogLimiter{window: window, entries: make(map[string]*suppressedErrors)}
+}
+
+// Allow reports whether the error with the key should be logged and how many identical ones were suppressed
+// since it was last logged. Every error is logged when the window is zero
+func (e *errorLogLimiter) Allow(key string) (bool, int) {
+	if e.window <= 0 {
+		return true, 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	entry, found := e.entries[key]
+	if found && now.Sub(entry.loggedAt) < e.window {
+		entry.count++
+		return false, 0
+	}
+	suppressed := 0
+	if found {
+		suppressed = entry.count
+	}
+	e.prune(now)
+	e.entries[key] = &suppressedErrors{loggedAt: now}
+	return true, suppressed
+}
+
+// prune drops the entries whose window has passed, at most once per window. Errors suppressed under a pruned key
+// aren't counted when it's logged again
+func (e *errorLogLimiter) prune(now time.Time) {
+	if now.Sub(e.prunedAt) < e.window {
+		return
+	}
+	for key, entry := range e.entries {
+		if now.Sub(entry.loggedAt) >= e.window {
+			delete(e.entries, key)
+		}
+	}
+	e.prunedAt = now
+}
+
+// AuditEntry is a line of the audit log, written for every attempt to save a link
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Chat       int64     `json:"chat"`
+	Url        string    `json:"url"`
+	Title      string    `json:"title,omitempty"`
+	BookmarkId int       `json:"bookmarkId,omitempty"`
+	Result     string    `json:"result"`
+}
+
+type AuditLog interface {
+	Record(entry AuditEntry)
+}
+
+type nopAuditLog struct{}
+
+func (nopAuditLog) Record(AuditEntry) {}
+
+// fileAuditLog appends JSON lines to a file
+type fileAuditLog struct {
+	mu      sync.Mutex
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+// NewFileAuditLog opens the file for appending, the audit log is a no-op when the path is empty
+func NewFileAuditLog(path string) (AuditLog, error) {
+	if path == "" {
+		return nopAuditLog{}, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to open audit log")
+	}
+	writer := bufio.NewWriter(file)
+	return &fileAuditLog{writer: writer, encoder: json.NewEncoder(writer)}, nil
+}
+
+// Record writes the entry, the buffer is flushed after every entry so a line is written at once and isn't
+// lost if the bot stops
+func (a *fileAuditLog) Record(entry AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.encoder.Encode(entry)
+	if err == nil {
+		err = a.writer.Flush()
+	}
+	if err != nil {
+		log.Errorf("Couldn't write to the audit log: %v", err)
+	}
+}
+
+// UserSet is a set of users by username or numeric user ID
+type UserSet struct {
+	usernames []string
+	ids       []int64
+}
+
+// ParseUserSet classifies the entries into usernames and user IDs. IDs are written as "id:12345" (or just the
+// number, usernames can't start with a digit), a leading "@" of usernames is stripped
+func ParseUserSet(entries []string) (UserSet, error) {
+	users := UserSet{usernames: make([]string, 0), ids: make([]int64, 0)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		rawId, isId := strings.CutPrefix(entry, "id:")
+		if !isId && entry != "" && unicode.IsDigit(rune(entry[0])) {
+			rawId, isId = entry, true
+		}
+		if !isId {
+			users.usernames = append(users.usernames, strings.TrimPrefix(entry, "@"))
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(rawId), 10, 64)
+		if err != nil {
+			return UserSet{}, errorx.IllegalArgument.New("invalid user ID in %q", entry)
+		}
+		users.ids = append(users.ids, id)
+	}
+	return users, nil
+}
+
+func (u UserSet) Contains(user *echotron.User) bool {
+	if user == nil {
+		return false
+	}
+	if user.Username != "" && contains(u.usernames, user.Username) {
+		return true
+	}
+	for _, id := range u.ids {
+		if id == user.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func (u UserSet) String() string {
+	return fmt.Sprintf("usernames %v, IDs %v", u.usernames, u.ids)
+}
+
+// logUrl returns the URL as it should be logged. With redaction the path and query are replaced with a short hash,
+// which still tells apart the logs of different URLs from the same host
+func logUrl(rawUrl string, redact bool) string {
+	if !redact {
+		return rawUrl
+	}
+	hash := sha256.Sum256([]byte(rawUrl))
+	return fmt.Sprintf("%s/#%s", hostOf(rawUrl), hex.EncodeToString(hash[:4]))
+}
+
+// redactUrlError redacts the URL the HTTP client puts into its errors, e.g. `Get "https://...": timeout`
+func redactUrlError(err error, redact bool) error {
+	var urlErr *url.Error
+	if redact && errors.As(err, &urlErr) {
+		urlErr.URL = logUrl(urlErr.URL, redact)
+	}
+	return err
+}
+
+// UrlNormalization lists the optional steps applied on top of the urlx normalization
+type UrlNormalization struct {
+	// StripWww drops the leading "www." of the host
+	StripWww bool
+	// ForceHttps rewrites http URLs to https
+	ForceHttps bool
+}
+
+// defaultPorts are dropped from the host, urlx does the same but the scheme may change after it
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// normalizeUrl normalizes the URL with urlx and then applies the optional normalization steps
+func normalizeUrl(rawUrl string, normalization UrlNormalization) (string, error) {
+	normalized, err := urlx.NormalizeString(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	if !normalization.StripWww && !normalization.ForceHttps {
+		return normalized, nil
+	}
+	parsed, err := url.Parse(normalized)
+	if err != nil {
+		return "", err
+	}
+	if normalization.ForceHttps && parsed.Scheme == "http" {
+		parsed.Scheme = "https"
+	}
+	host, port := parsed.Hostname(), parsed.Port()
+	if normalization.StripWww {
+		host = strings.TrimPrefix(host, "www.")
+	}
+	if port == defaultPorts[parsed.Scheme] {
+		port = ""
+	}
+	parsed.Host = host
+	if port != "" {
+		parsed.Host = net.JoinHostPort(host, port)
+	}
+	return parsed.String(), nil
+}
+
+type correlationIdKey struct{}
+
+// withCorrelationId tags the context with an ID that is logged by every step handling the update, so its logs
+// can be told apart from the ones of concurrent updates
+func withCorrelationId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIdKey{}, id)
+}
+
+func newCorrelationId() string {
+	id := make([]byte, 4)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// loggerFrom returns a logger with the correlation ID of the context, if any
+func loggerFrom(ctx context.Context) *log.Entry {
+	if ctx != nil {
+		if id, ok := ctx.Value(correlationIdKey{}).(string); ok {
+			return log.WithField("correlation_id", id)
+		}
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// Allowlist holds the users allowed to use the bot, they can be replaced on reload while updates are handled
+type Allowlist struct {
+	mu    sync.RWMutex
+	users UserSet
+}
+
+func NewAllowlist(users UserSet) *Allowlist {
+	return &Allowlist{users: users}
+}
+
+func (a *Allowlist) Set(users UserSet) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users = users
+}
+
+func (a *Allowlist) Allows(user *echotron.User) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users.Contains(user)
+}
+
+// readAllowlistFile reads one username or user ID per line, skipping blank lines and # comments
+func readAllowlistFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to read allowlist file")
+	}
+	entries := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, nil
+}
+
+// loadAllowlist combines the users from the environment with the ones in the allowlist file, if any
+func loadAllowlist(config *envConfig) (UserSet, error) {
+	entries := append([]string{}, config.AllowedUsernames...)
+	if config.AllowlistFile != "" {
+		fileEntries, err := readAllowlistFile(config.AllowlistFile)
+		if err != nil {
+			return UserSet{}, err
+		}
+		entries = append(entries, fileEntries...)
+	}
+	users, err := ParseUserSet(entries)
+	if err != nil {
+		return UserSet{}, errorx.Decorate(err, "failed to parse allowed users")
+	}
+	return users, nil
+}
+
+// reloadAllowlistOnSighup re-reads the allowlist file on every SIGHUP, keeping the current entries if it fails
+func reloadAllowlistOnSighup(allowlist *Allowlist, config *envConfig) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			users, err := loadAllowlist(config)
+			if err != nil {
+				log.Errorf("Couldn't reload the allowlist: %+v", err)
+				continue
+			}
+			allowlist.Set(users)
+			log.Printf("Allowlist reloaded: %v", users)
+		}
+	}()
+}
+
+// archiveStaleInterval is how often stale bookmarks are looked for, the age is counted in days anyway
+const archiveStaleInterval = time.Hour
+
+// archiveStaleBookmarks periodically archives the unread bookmarks with the tag that are older than maxAge
+func archiveStaleBookmarks(linkService LinkService, tag string, maxAge time.Duration) {
+	go func() {
+		ticker := time.NewTicker(archiveStaleInterval)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			ctx := withCorrelationId(context.Background(), newCorrelationId())
+			archived, err := linkService.ArchiveStale(ctx, tag, time.Now().Add(-maxAge))
+			if err != nil {
+				loggerFrom(ctx).Errorf("Couldn't archive stale bookmarks: %+v", err)
+			}
+			if archived > 0 {
+				loggerFrom(ctx).Printf("Archived %d stale bookmarks", archived)
+			}
+		}
+	}()
+}
+
+// loadLinkdingApiToken reads the token from LINKDING_API_TOKEN_FILE if it's set, otherwise it takes LINKDING_API_TOKEN
+// as re-read from the environment and app.env, so a rotated token is picked up on reload
+func loadLinkdingApiToken(config *envConfig) (string, error) {
+	if config.LinkdingApiTokenFile != "" {
+		data, err := os.ReadFile(config.LinkdingApiTokenFile)
+		if err != nil {
+			return "", errorx.Decorate(err, "failed to read linkding API token file")
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		return "", errorx.Decorate(err, "failed to read config")
+	}
+	return viper.GetString("LINKDING_API_TOKEN"), nil
+}
+
+// reloadLinkdingApiTokenOnSighup reloads the linkding API token on every SIGHUP, keeping the current one if it fails
+func reloadLinkdingApiTokenOnSighup(repository LinkdingRepository, config *envConfig) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			apiToken, err := loadLinkdingApiToken(config)
+			if err == nil && apiToken == "" {
+				err = errorx.IllegalArgument.New("linkding API token is empty")
+			}
+			if err != nil {
+				log.Errorf("Couldn't reload the linkding API token: %+v", err)
+				continue
+			}
+			repository.SetApiToken(apiToken)
+			log.Println("Linkding API token reloaded")
+		}
+	}()
+}
+
+// chatSettings are the per-chat defaults changed with /config
+type chatSettings struct {
+	tags    []string
+	read    bool
+	archive bool
+	shared  bool
+}
+
+// apply merges the chat defaults into the options extracted from a message
+func (c chatSettings) apply(options *SaveOptions) *SaveOptions {
+	options.TagNames = distinct(append(append([]string{}, c.tags...), options.TagNames...))
+	options.IsArchived = options.IsArchived || c.archive
+	options.MarkRead = options.MarkRead || c.read
+	options.Shared = options.Shared || c.shared
+	return options
+}
+
+func (c chatSettings) String() string {
+	tags := "none"
+	if len(c.tags) > 0 {
+		tags = strings.Join(c.tags, ", ")
+	}
+	return fmt.Sprintf("tags: %s\nunread: %s\narchive: %s\nshared: %s",
+		tags, onOff(!c.read), onOff(c.archive), onOff(c.shared))
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+// chatSettingsStore keeps the settings of every chat in memory
+type chatSettingsStore struct {
+	mu       sync.Mutex
+	settings map[int64]chatSettings
+}
+
+func newChatSettingsStore() *chatSettingsStore {
+	return &chatSettingsStore{settings: make(map[int64]chatSettings)}
+}
+
+func (s *chatSettingsStore) Get(chatId int64) chatSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.settings[chatId]
+}
+
+// Update changes the chat settings with the function and returns the result
+func (s *chatSettingsStore) Update(chatId int64, update func(settings *chatSettings)) chatSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings := s.settings[chatId]
+	update(&settings)
+	s.settings[chatId] = settings
+	return settings
+}
+
+// DefaultMaxUrlsPerMessage covers messages listing a few links while keeping spam with hundreds of them cheap
+const DefaultMaxUrlsPerMessage = 10
+
+// DefaultRecentSaveTtl catches links forwarded twice by accident without getting in the way of re-saving later
+const DefaultRecentSaveTtl = time.Minute
+
+// ArchiveHashtag marks a message whose link should be archived right away
+const ArchiveHashtag = "archive"
+
+// RawHashtag marks a message whose link should be saved as is, without fetching the page
+const RawHashtag = "raw"
+
+// TelegramApi is the subset of echotron.API used by the bot, so it can be replaced in tests
+type TelegramApi interface {
+	SendMessage(text string, chatID int64, opts *echotron.MessageOptions) (echotron.APIResponseMessage, error)
+	EditMessageText(
+		text string,
+		msg echotron.MessageIDOptions,
+		opts *echotron.MessageTextOptions,
+	) (echotron.APIResponseMessage, error)
+	SendDocument(file echotron.InputFile, chatID int64, opts *echotron.DocumentOptions) (echotron.APIResponseMessage, error)
+	SetMessageReaction(chatID int64, messageID int, opts *echotron.MessageReactionOptions) (echotron.APIResponseBool, error)
+}
+
+// BotOptions holds the optional behaviour of the bot
+type BotOptions struct {
+	// SaveTextNotes saves messages without URLs as notes
+	SaveTextNotes bool
+	// TimeWindows mark links read, unread or archived depending on the time of day they were sent at
+	TimeWindows []TimeWindow
+	// TimeWindowsLocation is the timezone the time windows and the date notes are in, UTC unless configured
+	TimeWindowsLocation *time.Location
+	// MaxUrlsPerMessage is how many of the URLs of a message are saved, the others are skipped. There's no limit
+	// when zero
+	MaxUrlsPerMessage int
+	// Username is the bot's own username, which group chat commands are addressed with
+	Username string
+	// AllowedSchemes are the URL schemes saved, links with other schemes are skipped
+	AllowedSchemes []string
+	// ReviewTag is added to the links saved with /review, which are saved unread no matter the chat settings
+	ReviewTag string
+	// ReactionReplies acknowledges saves with a reaction on the message instead of a reply, errors other than
+	// failed saves are still replied to
+	ReactionReplies bool
+	// ReplyOnNoUrls answers messages without URLs, turning it off keeps the bot quiet in group chats it reads
+	ReplyOnNoUrls bool
+	// SaveDocuments saves documents sent without URLs, e.g. PDFs, as notes titled with the file name. Telegram file
+	// URLs contain the bot token, so the note gets the placeholder URL of notePlaceholderUrl instead
+	SaveDocuments bool
+	// ParseMode formats replies as HTML or MarkdownV2, replies are plain text when empty
+	ParseMode echotron.ParseMode
+	// DateNote notes the date the message was sent on in the bookmark
+	DateNote bool
+	// ShowLatency adds how long fetching the page and creating the bookmark took to the reply
+	ShowLatency bool
+	// DisableReplyPreview keeps Telegram from rendering previews of the links in replies
+	DisableReplyPreview bool
+	// OptimisticReply replies "Saving..." right away and edits the reply once the save is done
+	OptimisticReply bool
+	// Admins are the usernames or user IDs allowed to use admin commands like /export
+	Admins UserSet
+	// AllowedChatTypes limits the chat types the bot works in, e.g. "private", any chat is fine when empty
+	AllowedChatTypes []string
+	// SilentChatTypeRejection ignores messages from other chat types without replying
+	SilentChatTypeRejection bool
+	// BatchWindow collects the links a chat sends within the window and saves them with a single reply,
+	// links are saved right away when zero
+	BatchWindow time.Duration
+	// RecentSaveTtl is how long a saved URL is answered with "Already saved recently." in the same chat
+	RecentSaveTtl time.Duration
+	// UrlNormalization tells apart the URLs of a message and the recent saves, it has to match the one of the link
+	// service
+	UrlNormalization UrlNormalization
+	// RedactUrlsInLogs logs only the host of URLs, see logUrl
+	RedactUrlsInLogs bool
+}
+
+type bot struct {
+	chatId        int64
+	allowlist     *Allowlist
+	urlExtractors []UrlExtractor
+	tagExtractor  TagExtractor
+	linkService   LinkService
+	lastSaved     *lastSavedTracker
+	nextTags      *nextTagsTracker
+	recentSaves   *recentSaves
+	chatSettings  *chatSettingsStore
+	options       BotOptions
+	batch         *updateBatch
+	auditLog      AuditLog
+	// ctx carries the correlation ID of the update being handled
+	ctx context.Context
+	// businessConnectionId routes replies through the business account the message was received on
+	businessConnectionId string
+	TelegramApi
+}
+
+// forUpdate returns a copy of the bot handling a single message, with its own correlation ID and replying through
+// the message's business connection, if any. Updates of a chat are handled concurrently, so the bot itself isn't
+// changed
+func (b *bot) forUpdate(msg *echotron.Message) *bot {
+	copied := *b
+	copied.ctx = withCorrelationId(context.Background(), newCorrelationId())
+	copied.businessConnectionId = msg.BusinessConnectionID
+	return &copied
+}
+
+// isBusiness tells whether the message came through a business connection. Replies to business messages are shown
+// to the other party of the chat, so only saves are answered there
+func (b *bot) isBusiness() bool {
+	return b.businessConnectionId != ""
+}
+
+func (b *bot) logger() *log.Entry {
+	return loggerFrom(b.ctx)
+}
+
+// maybeSendMessage sends plain text, escaping it for the configured parse mode
+func (b *bot) maybeSendMessage(text string) {
+	b.maybeSendFormattedMessage(b.escape(text))
+}
+
+func (b *bot) escape(text string) string {
+	return escapeForParseMode(text, b.options.ParseMode)
+}
+
+// maybeSendPendingMessage acknowledges a save before it's done when optimistic replies are enabled,
+// returning the message to edit with the result or nil
+func (b *bot) maybeSendPendingMessage() *echotron.Message {
+	// replies to business messages are shown to the other party, so they get the final result only
+	if !b.options.OptimisticReply || b.isBusiness() {
+		return nil
+	}
+	res, err := b.SendMessage(b.escape("Saving..."), b.chatId, b.messageOptions())
+	if err != nil {
+		b.logger().Printf("Send message error: %v", err)
+		return nil
+	}
+	return res.Result
+}
+
+// finishPendingMessage replaces the pending message with the formatted result or sends the result if there's none.
+// A result too long for one message replaces the pending message with its first chunk, the rest is sent after it
+func (b *bot) finishPendingMessage(pending *echotron.Message, text string) {
+	if pending == nil {
+		b.maybeSendFormattedMessage(text)
+		return
+	}
+	chunks := chunkMessage(text, TelegramMessageMaxLength)
+	if len(chunks) == 0 {
+		return
+	}
+	_, err := b.EditMessageText(chunks[0], echotron.NewMessageID(b.chatId, pending.ID), &echotron.MessageTextOptions{
+		ParseMode:          b.options.ParseMode,
+		LinkPreviewOptions: b.linkPreviewOptions(),
+	})
+	if err != nil {
+		b.logger().Printf("Edit message error: %v", err)
+	}
+	for _, chunk := range chunks[1:] {
+		b.maybeSendFormattedMessage(chunk)
+	}
+}
+
+// maybeSendFormattedMessage sends text that is already formatted for the configured parse mode, split into several
+// messages if it's too long for one
+func (b *bot) maybeSendFormattedMessage(text string) {
+	for _, chunk := range chunkMessage(text, TelegramMessageMaxLength) {
+		_, err := b.SendMessage(chunk, b.chatId, b.messageOptions())
+		if err != nil {
+			b.logger().Printf("Send message error: %v", err)
+		}
+	}
+}
+
+// TelegramMessageMaxLength is the longest message text Telegram accepts, in UTF-16 code units
+const TelegramMessageMaxLength = 4096
+
+// chunkMessage splits the text into chunks of at most maxLength UTF-16 code units. It splits between lines, so
+// entries like the ones of a batch reply stay whole, and only lines too long on their own are split between runes
+func chunkMessage(text string, maxLength int) []string {
+	chunks := make([]string, 0, 1)
+	var chunk strings.Builder
+	chunkLength := 0
+	flush := func() {
+		if chunk.Len() > 0 {
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
+			chunkLength = 0
+		}
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		lineLength := utf16Length(line)
+		if chunkLength+lineLength > maxLength {
+			flush()
+		}
+		for lineLength > maxLength {
+			// the line alone is too long, cut it at the last rune that fits
+			cut, length := 0, 0
+			for i, r := range line {
+				if length+utf16RuneLength(r) > maxLength {
+					cut = i
+					break
+				}
+				length += utf16RuneLength(r)
+			}
+			chunks = append(chunks, line[:cut])
+			line = line[cut:]
+			lineLength -= length
+		}
+		chunk.WriteString(line)
+		chunkLength += lineLength
+	}
+	flush()
+	return chunks
+}
+
+// utf16Length returns the length of the text in UTF-16 code units, the way Telegram counts it
+func utf16Length(text string) int {
+	length := 0
+	for _, r := range text {
+		length += utf16RuneLength(r)
+	}
+	return length
+}
+
+// utf16RuneLength returns 2 for runes encoded as a surrogate pair and 1 for the others
+func utf16RuneLength(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+func (b *bot) messageOptions() *echotron.MessageOptions {
+	return &echotron.MessageOptions{
+		BusinessConnectionID: b.businessConnectionId,
+		ParseMode:            b.options.ParseMode,
+		LinkPreviewOptions:   b.linkPreviewOptions(),
+	}
+}
+
+func (b *bot) linkPreviewOptions() echotron.LinkPreviewOptions {
+	return echotron.LinkPreviewOptions{IsDisabled: b.options.DisableReplyPreview}
+}
+
+// savedReply links the saved bookmark in the reply when replies are formatted
+func (b *bot) savedReply(bookmark *Bookmark) string {
+	if b.options.ParseMode == "" || bookmark == nil {
+		return "Saved!"
+	}
+	title := bookmark.Title
+	if title == "" {
+		title = bookmark.URL
+	}
+	return b.escape("Saved: ") + formatLink(title, bookmark.URL, b.options.ParseMode)
+}
+
+func (b *bot) Update(update *echotron.Update) {
+	msg := update.Message
+	if msg == nil {
+		msg = update.BusinessMessage
+	}
+	if msg == nil {
+		return
+	}
+	b = b.forUpdate(msg)
+
+	if len(b.options.AllowedChatTypes) > 0 && !contains(b.options.AllowedChatTypes, msg.Chat.Type) {
+		b.logger().Debugf("Chat type %s is not allowed", msg.Chat.Type)
+		if !b.options.SilentChatTypeRejection {
+			b.maybeSendMessage("This bot doesn't work in this chat")
+		}
+		return
+	}
+
+	command, args, isCommand := parseCommand(msg.Text, b.options.Username)
+	if isCommand && command == "" {
+		b.logger().Debug("Ignoring a command addressed to another bot")
+		return
+	}
+
+	// answered for everyone, so users not on the allowlist yet can send their ID to the operator
+	if isCommand && command == "whoami" {
+		if !b.isBusiness() {
+			b.whoami(msg.From)
+		}
+		return
+	}
+
+	if !b.allowlist.Allows(msg.From) {
+		b.logger().Debugf("User %v is not allowed", msg.From)
+		if !b.isBusiness() {
+			b.maybeSendMessage("You are not allowed to use this bot")
+		}
+		return
+	}
+
+	if b.options.RedactUrlsInLogs {
+		// the message text holds the URLs
+		b.logger().Debugf("Received message %d", msg.ID)
+	} else {
+		b.logger().Debugf("Received message: %v", msg)
+	}
+
+	if isCommand {
+		b.handleCommand(msg, command, args)
+		return
+	}
+
+	urls, valid := messageUrls(b.logger(), msg, b.urlExtractors, b.options)
+
+	if len(urls) == 0 && b.options.SaveTextNotes && strings.TrimSpace(msg.Text) != "" {
+		b.saveNote(msg, msg.Text)
+		return
+	}
+	if len(urls) == 0 && b.options.SaveDocuments && msg.Document != nil {
+		b.saveNote(msg, documentNote(msg))
+		return
+	}
+	if len(urls) == 0 {
+		b.logger().Debug("No URLs found")
+		if b.options.ReplyOnNoUrls && !b.isBusiness() {
+			b.maybeSendMessage("No URLs found in the message")
+		}
+		return
+	}
+
+	// URLs were found but none of them can be saved, which is told apart from a message without any URLs
+	urls = valid
+	if len(urls) == 0 {
+		b.logger().Debug("No savable URLs found")
+		if !b.isBusiness() {
+			b.maybeSendMessage("No savable URLs in the message (all blocked or invalid)")
+		}
+		return
+	}
+
+	options := b.applyTimeWindow(msg, b.chatSettings.Get(b.chatId).apply(&SaveOptions{
+		TagNames:    b.tagExtractor(msg),
+		IsArchived:  contains(GetHashtags(msg), ArchiveHashtag),
+		Notes:       b.dateNote(msg),
+		Description: GetDescription(msg),
+		SkipFetch:   contains(GetHashtags(msg), RawHashtag),
+	}))
+
+	skipped := 0
+	if maxUrls := b.options.MaxUrlsPerMessage; maxUrls > 0 && len(urls) > maxUrls {
+		b.logger().Debugf("Skipping %d URLs over the limit of %d per message", len(urls)-maxUrls, maxUrls)
+		skipped, urls = len(urls)-maxUrls, urls[:maxUrls]
+	}
+	if b.options.BatchWindow > 0 {
+		b.addToBatch(msg.From, urls, skipped, options)
+		return
+	}
+	if len(urls) > 1 || skipped > 0 {
+		entries := make([]batchEntry, 0, len(urls))
+		for _, u := range urls {
+			entries = append(entries, batchEntry{b.ctx, msg.From, u, options})
+		}
+		pending := b.maybeSendPendingMessage()
+		reply := b.saveAll(entries)
+		b.finishPendingMessage(pending, reply+b.skippedNote(skipped))
+		return
+	}
+
+	firstUrl := urls[0]
+	if b.recentSaves.Seen(b.chatId, firstUrl) {
+		b.logger().WithField("url", logUrl(firstUrl, b.options.RedactUrlsInLogs)).Debug("URL was saved recently")
+		b.auditRecentDuplicate(msg.From, firstUrl)
+		b.maybeSendMessage("Already saved recently.")
+		return
+	}
+
+	if b.options.ReactionReplies && !b.isBusiness() {
+		reply, result := b.save(b.ctx, msg.From, firstUrl, options)
+		b.reactOrReply(msg, result == SaveResultSaved, reply)
+		return
+	}
+	pending := b.maybeSendPendingMessage()
+	reply, _ := b.save(b.ctx, msg.From, firstUrl, options)
+	b.finishPendingMessage(pending, reply)
+}
+
+// Telegram only accepts reactions from a fixed set of emoji, which has no check or cross marks
+const (
+	SavedReaction  = "👍"
+	FailedReaction = "👎"
+)
+
+// reactOrReply acknowledges the save with a reaction on the message, falling back to the formatted reply when the
+// reaction can't be set, e.g. because the chat disabled reactions
+func (b *bot) reactOrReply(msg *echotron.Message, saved bool, reply string) {
+	emoji := SavedReaction
+	if !saved {
+		emoji = FailedReaction
+	}
+	_, err := b.SetMessageReaction(b.chatId, msg.ID, &echotron.MessageReactionOptions{
+		Reaction: []echotron.ReactionType{{Type: "emoji", Emoji: emoji}},
+	})
+	if err != nil {
+		b.logger().Debugf("Couldn't set a reaction, replying instead: %v", err)
+		b.maybeSendFormattedMessage(reply)
+	}
+}
+
+// responseDetails describes the unexpected linkding response that caused the error for admins debugging it,
+// e.g. " (status 502: Bad Gateway)". It's empty for other errors
+func responseDetails(err error) string {
+	status, found := errorx.ExtractProperty(err, PropertyStatus)
+	if !found {
+		return ""
+	}
+	if snippet, _ := errorx.ExtractProperty(err, PropertyResponseSnippet); snippet != nil && snippet != "" {
+		return fmt.Sprintf(" (status %v: %v)", status, snippet)
+	}
+	return fmt.Sprintf(" (status %v)", status)
+}
+
+// SaveResult is the outcome of saving a URL, summarized in the reply to several URLs
+type SaveResult string
+
+const (
+	SaveResultSaved     SaveResult = "new"
+	SaveResultDuplicate SaveResult = "duplicate"
+	SaveResultFailed    SaveResult = "failed"
+)
+
+// save saves the URL sent by the user and returns the formatted reply and the outcome
+func (b *bot) save(ctx context.Context, user *echotron.User, url string, options *SaveOptions) (string, SaveResult) {
+	if nextTags := b.nextTags.Pop(b.chatId); len(nextTags) > 0 {
+		withNextTags := *options
+		withNextTags.TagNames = distinct(append(append([]string{}, options.TagNames...), nextTags...))
+		options = &withNextTags
+	}
+	startTime := time.Now()
+	bookmark, err := b.linkService.Save(ctx, url, options)
+	latency := time.Since(startTime)
+	entry := AuditEntry{Time: time.Now(), Chat: b.chatId, Url: url}
+	if user != nil {
+		entry.User = user.Username
+	}
+	if err != nil {
+		loggerFrom(ctx).WithField("url", logUrl(url, b.options.RedactUrlsInLogs)).Debugf("Couldn't save a link: %+v", err)
+		var reply string
+		switch {
+		case errorx.IsOfType(err, UrlTooLong):
+			entry.Result, reply = "url_too_long", "URL too long."
+		case errorx.HasTrait(err, errorx.Duplicate()):
+			entry.Result, reply = "duplicate", "Already bookmarked"
+		case errorx.HasTrait(err, errorx.Temporary()):
+			entry.Result, reply = "unavailable", "Linkding is unavailable, try again later"
+		default:
+			entry.Result, reply = "error", "Error"
+		}
+		b.auditLog.Record(entry)
+		if b.options.Admins.Contains(user) {
+			reply += responseDetails(err)
+		}
+		if entry.Result == "duplicate" {
+			return b.escape(reply), SaveResultDuplicate
+		}
+		return b.escape(reply), SaveResultFailed
+	}
+	entry.Result = "saved"
+	if bookmark != nil {
+		entry.Title, entry.BookmarkId = bookmark.Title, bookmark.ID
+	}
+	b.auditLog.Record(entry)
+
+	b.recentSaves.Add(b.chatId, url)
+	if bookmark != nil {
+		b.lastSaved.Set(b.chatId, user, bookmark)
+	}
+	reply := b.savedReply(bookmark)
+	if b.options.ShowLatency {
+		reply += b.escape(fmt.Sprintf(" (%.1fs)", latency.Seconds()))
+	}
+	return reply, SaveResultSaved
+}
+
+type batchEntry struct {
+	ctx     context.Context
+	user    *echotron.User
+	url     string
+	options *SaveOptions
+}
+
+// updateBatch collects the links of the updates a chat sends within the batch window, e.g. a bunch of forwarded
+// messages, so they are saved together with a single reply
+type updateBatch struct {
+	mu      sync.Mutex
+	entries []batchEntry
+	// skipped counts the URLs over MaxUrlsPerMessage of the batched messages
+	skipped int
+}
+
+// addToBatch queues the URLs of a message and counts the ones skipped over the limit, the first message queued
+// starts the window after which the batch is saved
+func (b *bot) addToBatch(user *echotron.User, urls []string, skipped int, options *SaveOptions) {
+	b.batch.mu.Lock()
+	defer b.batch.mu.Unlock()
+	if len(b.batch.entries) == 0 {
+		time.AfterFunc(b.options.BatchWindow, b.flushBatch)
+	}
+	for _, u := range urls {
+		b.batch.entries = append(b.batch.entries, batchEntry{b.ctx, user, u, options})
+	}
+	b.batch.skipped += skipped
+}
+
+// flushBatch saves the queued URLs and replies with a summary
+func (b *bot) flushBatch() {
+	b.batch.mu.Lock()
+	entries, skipped := b.batch.entries, b.batch.skipped
+	b.batch.entries, b.batch.skipped = nil, 0
+	b.batch.mu.Unlock()
+
+	b.maybeSendFormattedMessage(b.saveAll(entries) + b.skippedNote(skipped))
+}
+
+// skippedNote is the formatted line appended to a summary when URLs over MaxUrlsPerMessage were skipped
+func (b *bot) skippedNote(skipped int) string {
+	if skipped == 0 {
+		return ""
+	}
+	return "\n" + b.escape(fmt.Sprintf("Skipped %d more links, at most %d are saved per message",
+		skipped, b.options.MaxUrlsPerMessage))
+}
+
+// auditRecentDuplicate records a URL answered with "Already saved recently." without asking linkding again
+func (b *bot) auditRecentDuplicate(user *echotron.User, url string) {
+	entry := AuditEntry{Time: time.Now(), Chat: b.chatId, Url: url, Result: "recent_duplicate"}
+	if user != nil {
+		entry.User = user.Username
+	}
+	b.auditLog.Record(entry)
+}
+
+// saveAll saves the URLs, skipping repeated ones, and returns the formatted summary or the reply of a single URL.
+// The summary counts the outcomes, e.g. "2 new, 1 duplicate, 1 failed", and lists the URLs that failed
+func (b *bot) saveAll(entries []batchEntry) string {
+	replies := make([]string, 0, len(entries))
+	counts := make(map[SaveResult]int)
+	failed := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		key := urlDedupKey(entry.url, b.options.UrlNormalization)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		reply, result := b.escape("Already saved recently."), SaveResultDuplicate
+		if b.recentSaves.Seen(b.chatId, entry.url) {
+			b.auditRecentDuplicate(entry.user, entry.url)
+		} else {
+			reply, result = b.save(entry.ctx, entry.user, entry.url, entry.options)
+		}
+		counts[result]++
+		if result == SaveResultFailed {
+			failed = append(failed, b.escape(entry.url+" - ")+reply)
+		}
+		replies = append(replies, reply)
+	}
+
+	if len(replies) == 1 {
+		return replies[0]
+	}
+	summary := make([]string, 0, 3)
+	for _, result := range []SaveResult{SaveResultSaved, SaveResultDuplicate, SaveResultFailed} {
+		if counts[result] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[result], result))
+		}
+	}
+	lines := append([]string{b.escape(strings.Join(summary, ", "))}, failed...)
+	return strings.Join(lines, "\n")
+}
+
+// Time window actions, unread overrides a read default of the chat
+const (
+	TimeWindowUnread  = "unread"
+	TimeWindowRead    = "read"
+	TimeWindowArchive = "archive"
+)
+
+// TimeWindow applies its action to the links sent between From and To, which wraps around midnight when To is
+// earlier than From. Both are offsets from midnight
+type TimeWindow struct {
+	From   time.Duration
+	To     time.Duration
+	Action string
+}
+
+func (w TimeWindow) Contains(t time.Time) bool {
+	hour, minute, _ := t.Clock()
+	offset := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute
+	if w.From <= w.To {
+		return offset >= w.From && offset < w.To
+	}
+	return offset >= w.From || offset < w.To
+}
+
+// parseTimeWindows parses a list of "HH:MM-HH:MM=action" entries, e.g. "23:00-06:00=archive"
+func parseTimeWindows(entries []string) ([]TimeWindow, error) {
+	windows := make([]TimeWindow, 0, len(entries))
+	for _, entry := range entries {
+		span, action, _ := strings.Cut(entry, "=")
+		from, to, _ := strings.Cut(span, "-")
+		fromTime, fromErr := time.Parse("15:04", strings.TrimSpace(from))
+		toTime, toErr := time.Parse("15:04", strings.TrimSpace(to))
+		action = strings.ToLower(strings.TrimSpace(action))
+		if fromErr != nil || toErr != nil || !contains([]string{TimeWindowUnread, TimeWindowRead, TimeWindowArchive}, action) {
+			return nil, errorx.IllegalArgument.New("invalid time window %q, expected HH:MM-HH:MM=unread|read|archive", entry)
+		}
+		windows = append(windows, TimeWindow{
+			From:   time.Duration(fromTime.Hour())*time.Hour + time.Duration(fromTime.Minute())*time.Minute,
+			To:     time.Duration(toTime.Hour())*time.Hour + time.Duration(toTime.Minute())*time.Minute,
+			Action: action,
+		})
+	}
+	return windows, nil
 }
 
-func contains(arr []string, str string) bool {
-	for _, a := range arr {
-		if a == str {
-			return true
+// applyTimeWindow adjusts the options by the first time window the message was sent in, if any
+func (b *bot) applyTimeWindow(msg *echotron.Message, options *SaveOptions) *SaveOptions {
+	sentAt := time.Unix(int64(msg.Date), 0).In(b.options.TimeWindowsLocation)
+	for _, window := range b.options.TimeWindows {
+		if !window.Contains(sentAt) {
+			continue
 		}
+		switch window.Action {
+		case TimeWindowUnread:
+			options.MarkRead = false
+		case TimeWindowRead:
+			options.MarkRead = true
+		case TimeWindowArchive:
+			options.IsArchived = true
+		}
+		return options
 	}
-	return false
+	return options
 }
 
-type CreateBookmarkPayload struct {
-	URL         string   `json:"url"`
-	Title       string   `json:"title"`
-	Description string   `json:"description"`
-	Notes       string   `json:"notes"`
-	IsArchived  bool     `json:"is_archived"`
-	Unread      bool     `json:"unread"`
-	Shared      bool     `json:"shared"`
-	TagNames    []string `json:"tag_names"`
+func (b *bot) dateNote(msg *echotron.Message) string {
+	if !b.options.DateNote {
+		return ""
+	}
+	sentAt := time.Unix(int64(msg.Date), 0).In(b.options.TimeWindowsLocation)
+	return fmt.Sprintf("Saved via Telegram on %s", sentAt.Format("2006-01-02"))
 }
 
-type LinkdingRepository interface {
-	CreateBookmark(payload *CreateBookmarkPayload) error
+// parseCommand splits a "/command args" message at the first whitespace, e.g. a line break, into the command name
+// and its arguments. In group chats commands come as "/command@botname", the command is empty when it's addressed
+// to another bot than botUsername
+func parseCommand(text, botUsername string) (command, args string, ok bool) {
+	if !strings.HasPrefix(text, "/") {
+		return "", "", false
+	}
+	command, args = text[1:], ""
+	if i := strings.IndexFunc(command, unicode.IsSpace); i >= 0 {
+		command, args = command[:i], command[i:]
+	}
+	command, mention, mentioned := strings.Cut(command, "@")
+	if command == "" {
+		return "", "", false
+	}
+	if mentioned && !strings.EqualFold(mention, botUsername) {
+		return "", "", true
+	}
+	return strings.ToLower(command), strings.TrimSpace(args), true
 }
 
-type linkdingRepository struct {
-	baseUrl  string
-	apiToken string
+func (b *bot) handleCommand(msg *echotron.Message, command, args string) {
+	switch command {
+	case "toggle_archive":
+		b.toggleBookmark(args, b.linkService.ToggleArchived)
+	case "toggle_read":
+		b.toggleBookmark(args, b.linkService.ToggleUnread)
+	case "undo":
+		b.undo(msg.From)
+	case "delete":
+		b.delete(args)
+	case "review":
+		b.review(msg.From, args)
+	case "refresh":
+		b.refresh(args)
+	case "config":
+		b.configure(args)
+	case "nexttag":
+		b.setNextTags(args)
+	case "export":
+		if !b.options.Admins.Contains(msg.From) {
+			b.maybeSendMessage("Only admins can export bookmarks")
+			return
+		}
+		b.export()
+	default:
+		b.logger().Debugf("Unknown command: %s", command)
+		if !b.isBusiness() {
+			b.maybeSendMessage("Unknown command")
+		}
+	}
 }
 
-func (l *linkdingRepository) CreateBookmark(payload *CreateBookmarkPayload) error {
-	postBody, err := json.Marshal(payload)
-	if err != nil {
-		return errorx.Decorate(err, "failed to marshal payload")
+// whoami replies with the sender's own ID and username, the entries ALLOWED_USERNAMES accepts
+func (b *bot) whoami(user *echotron.User) {
+	if user == nil {
+		b.maybeSendMessage("The message has no sender, e.g. it was sent on behalf of a channel")
+		return
+	}
+	reply := fmt.Sprintf("ID: %d", user.ID)
+	if user.Username != "" {
+		reply += fmt.Sprintf("\nUsername: @%s", user.Username)
 	}
-	postBodyBuffer := bytes.NewBuffer(postBody)
+	b.maybeSendMessage(reply + fmt.Sprintf("\nAdd id:%d to ALLOWED_USERNAMES to allow this account", user.ID))
+}
 
-	path, err := url.JoinPath(l.baseUrl, "api/bookmarks/")
-	if err != nil {
-		return errorx.Decorate(err, "failed to join path")
+func (b *bot) toggleBookmark(url string, toggle func(ctx context.Context, url string) (*Bookmark, error)) {
+	if url == "" {
+		b.maybeSendMessage("Usage: /toggle_archive <url> or /toggle_read <url>")
+		return
 	}
 
-	req, err := http.NewRequest("POST", path, postBodyBuffer)
+	bookmark, err := toggle(b.ctx, url)
+	if errorx.HasTrait(err, errorx.NotFound()) {
+		b.maybeSendMessage("Not found")
+		return
+	}
 	if err != nil {
-		return errorx.Decorate(err, "failed to create request")
+		b.logger().Debugf("Couldn't toggle a bookmark: %+v", err)
+		b.maybeSendMessage("Error")
+		return
 	}
 
-	req.Header.Set("Content-Type", ApplicationJson)
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", l.apiToken))
+	archived, read := "not archived", "read"
+	if bookmark.IsArchived {
+		archived = "archived"
+	}
+	if bookmark.Unread {
+		read = "unread"
+	}
+	b.maybeSendMessage(fmt.Sprintf("Bookmark is now %s and %s", archived, read))
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// export sends all bookmarks as a JSON document. The bookmarks are written to a temporary file as they are
+// fetched, so large collections aren't held in memory
+func (b *bot) export() {
+	file, err := os.CreateTemp("", "linkding-export-*.json")
 	if err != nil {
-		return errorx.Decorate(err, "failed to send request")
+		b.logger().Errorf("Couldn't create an export file: %+v", err)
+		b.maybeSendMessage("Error")
+		return
 	}
-	defer resp.Body.Close()
+	defer os.Remove(file.Name())
+	defer file.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
+	count, err := writeBookmarksJson(b.ctx, file, b.linkService)
+	if err == nil {
+		err = file.Close()
+	}
 	if err != nil {
-		return errorx.Decorate(err, "failed to read response body")
+		b.logger().Errorf("Couldn't export bookmarks: %+v", err)
+		b.maybeSendMessage("Error")
+		return
 	}
 
-	if resp.StatusCode != http.StatusCreated {
-		log.Printf("%s", respBody)
-		return errorx.IllegalState.New("unexpected status code %d", resp.StatusCode)
+	_, err = b.SendDocument(echotron.NewInputFilePath(file.Name()), b.chatId, &echotron.DocumentOptions{
+		Caption: fmt.Sprintf("%d bookmarks", count),
+	})
+	if err != nil {
+		b.logger().Errorf("Couldn't send the export: %+v", err)
+		b.maybeSendMessage("Error")
 	}
-	return nil
-}
-
-func NewLinkdingRepository(baseUrl, apiToken string) LinkdingRepository {
-	return &linkdingRepository{baseUrl, apiToken}
-}
-
-type PageInfo struct {
-	url         string
-	title       string
-	description string
-}
-
-type PageInfoService interface {
-	GetPageInfo(url string) (*PageInfo, error)
-}
-
-type pageInfoService struct {
 }
 
-func NewPageInfoService() PageInfoService {
-	return &pageInfoService{}
-}
-
-func (p *pageInfoService) GetPageInfo(url string) (*PageInfo, error) {
-	resp, err := http.Get(url)
+// writeBookmarksJson writes every bookmark as a JSON array, returning how many were written
+func writeBookmarksJson(ctx context.Context, w io.Writer, linkService LinkService) (int, error) {
+	count := 0
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return 0, errorx.Decorate(err, "failed to write export")
+	}
+	encoder := json.NewEncoder(w)
+	err := linkService.ForEachBookmark(ctx, func(bookmark *Bookmark) error {
+		if count > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return errorx.Decorate(err, "failed to write export")
+			}
+		}
+		count++
+		if err := encoder.Encode(bookmark); err != nil {
+			return errorx.Decorate(err, "failed to write export")
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, errorx.Decorate(err, "failed to fetch URL")
+		return count, err
 	}
-	defer resp.Body.Close()
+	if _, err = io.WriteString(w, "]\n"); err != nil {
+		return count, errorx.Decorate(err, "failed to write export")
+	}
+	return count, nil
+}
 
-	info := htmlinfo.NewHTMLInfo()
-	info.AllowOembedFetching = true
+const configUsage = "Usage: /config, /config tags <tag,...>, /config unread|archive|shared on|off"
 
-	ct := resp.Header.Get("Content-Type")
-	if err = info.Parse(resp.Body, &url, &ct); err != nil {
-		return nil, errorx.Decorate(err, "failed to parse page info")
+// configure shows or changes the defaults applied to every save in this chat
+func (b *bot) configure(args string) {
+	if args == "" {
+		b.maybeSendMessage(b.chatSettings.Get(b.chatId).String())
+		return
 	}
 
-	oembed := info.GenerateOembedFor(url)
-	output := &PageInfo{
-		url: url,
-	}
-	if oembed != nil {
-		output.title = oembed.Title
-		output.description = oembed.Description
+	key, value, _ := strings.Cut(args, " ")
+	value = strings.TrimSpace(value)
+	var update func(settings *chatSettings)
+	if strings.ToLower(key) == "tags" {
+		tags := parseTagList(value)
+		update = func(settings *chatSettings) { settings.tags = tags }
 	} else {
-		output.title = info.Title
-		output.description = info.Description
+		enabled, ok := parseOnOff(value)
+		if !ok {
+			b.maybeSendMessage(configUsage)
+			return
+		}
+		switch strings.ToLower(key) {
+		case "unread":
+			update = func(settings *chatSettings) { settings.read = !enabled }
+		case "archive":
+			update = func(settings *chatSettings) { settings.archive = enabled }
+		case "shared":
+			update = func(settings *chatSettings) { settings.shared = enabled }
+		default:
+			b.maybeSendMessage(configUsage)
+			return
+		}
 	}
-	return output, nil
+	b.maybeSendMessage(b.chatSettings.Update(b.chatId, update).String())
 }
 
-type LinkService interface {
-	Save(url string) error
+// parseTagList parses comma separated tags given to a command
+func parseTagList(value string) []string {
+	tags := make([]string, 0)
+	for _, name := range strings.Split(value, ",") {
+		if tag := sanitizeTag(name); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return distinct(tags)
 }
 
-type linkdingLinkService struct {
-	repository      LinkdingRepository
-	pageInfoService PageInfoService
+// setNextTags stores tags for the next link saved in the chat, e.g. for forwards that can't have hashtags added
+func (b *bot) setNextTags(args string) {
+	tags := parseTagList(args)
+	if len(tags) == 0 {
+		b.maybeSendMessage("Usage: /nexttag <tag,...>")
+		return
+	}
+	b.nextTags.Set(b.chatId, tags)
+	b.maybeSendMessage(fmt.Sprintf("The next link will be tagged %s", strings.Join(tags, ", ")))
 }
 
-func NewLinkdingLinkService(repository LinkdingRepository, pageInfoService PageInfoService) LinkService {
-	return &linkdingLinkService{repository, pageInfoService}
+func parseOnOff(value string) (enabled, ok bool) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes":
+		return true, true
+	case "off", "false", "no":
+		return false, true
+	}
+	return false, false
 }
 
-func (l *linkdingLinkService) Save(url string) error {
-	log.Debugf("Saving url: %s", url)
-
-	normalizedUrl, err := urlx.NormalizeString(url)
-	if err != nil {
-		return errorx.Decorate(err, "failed to normalize URL")
+// undo deletes the last bookmark the user saved in this chat
+func (b *bot) undo(user *echotron.User) {
+	last, found := b.lastSaved.Pop(b.chatId, user)
+	if !found {
+		b.maybeSendMessage("Nothing to undo")
+		return
 	}
-	log.Debugf("Normalized URL: %s", normalizedUrl)
-
-	fromTime := time.Now()
-	pageInfo, err := l.pageInfoService.GetPageInfo(normalizedUrl)
-	if err != nil {
-		return errorx.Decorate(err, "failed to get page info")
+	if err := b.linkService.Delete(b.ctx, last.id); err != nil {
+		b.logger().WithField("url", logUrl(last.url, b.options.RedactUrlsInLogs)).Debugf("Couldn't undo a save: %+v", err)
+		b.maybeSendMessage("Error")
+		return
 	}
-	toTime := time.Now()
-	log.Debugf("Completed page info fetch in %s", toTime.Sub(fromTime))
+	b.recentSaves.Forget(b.chatId, last.url)
+	b.maybeSendMessage(fmt.Sprintf("Removed %s", last.url))
+}
 
-	payload := CreateBookmarkPayload{
-		URL:         normalizedUrl,
-		Title:       pageInfo.title,
-		Description: pageInfo.description,
-		Notes:       "",
-		IsArchived:  false,
-		Unread:      true,
-		Shared:      false,
-		TagNames:    []string{},
+// review saves the URL unread and tagged for review, for links to come back to rather than to archive right away
+func (b *bot) review(user *echotron.User, url string) {
+	if url == "" {
+		b.maybeSendMessage("Usage: /review <url>")
+		return
+	}
+	if !isValidUrl(url, b.options.AllowedSchemes) {
+		b.maybeSendMessage("Invalid URL")
+		return
 	}
 
-	fromTime = time.Now()
-	err = l.repository.CreateBookmark(&payload)
-	toTime = time.Now()
-	log.WithField("error", err).Debugf("Completed bookmark creation in %s", toTime.Sub(fromTime))
-
-	return err
+	options := b.chatSettings.Get(b.chatId).apply(&SaveOptions{})
+	options.IsArchived, options.MarkRead, options.ForceUnread = false, false, true
+	if b.options.ReviewTag != "" {
+		options.TagNames = distinct(append(options.TagNames, b.options.ReviewTag))
+	}
+	pending := b.maybeSendPendingMessage()
+	reply, result := b.save(b.ctx, user, url, options)
+	if result == SaveResultSaved {
+		reply = b.escape("Queued for review")
+	}
+	b.finishPendingMessage(pending, reply)
 }
 
-type bot struct {
-	chatId           int64
-	allowedUsernames []string
-	urlExtractor     UrlExtractor
-	linkService      LinkService
-	echotron.API
-}
+// delete deletes the bookmark of any URL, unlike undo which only removes the last saved one
+func (b *bot) delete(url string) {
+	if url == "" {
+		b.maybeSendMessage("Usage: /delete <url>")
+		return
+	}
 
-func (b *bot) maybeSendMessage(text string) {
-	_, err := b.SendMessage(text, b.chatId, nil)
+	err := b.linkService.DeleteByUrl(b.ctx, url)
+	if errorx.HasTrait(err, errorx.NotFound()) {
+		b.maybeSendMessage("Not found")
+		return
+	}
 	if err != nil {
-		log.Printf("Send message error: %v", err)
+		b.logger().WithField("url", logUrl(url, b.options.RedactUrlsInLogs)).Debugf("Couldn't delete a bookmark: %+v", err)
+		b.maybeSendMessage("Error")
+		return
 	}
+	b.recentSaves.Forget(b.chatId, url)
+	b.maybeSendMessage("Deleted")
 }
 
-func (b *bot) Update(update *echotron.Update) {
-	msg := update.Message
-	if msg == nil {
+// refresh updates the title and description of the URL's bookmark from the page, e.g. after its tags were fixed
+func (b *bot) refresh(url string) {
+	if url == "" {
+		b.maybeSendMessage("Usage: /refresh <url>")
 		return
 	}
 
-	if !contains(b.allowedUsernames, msg.From.Username) {
-		log.Debugf("Username %s is not allowed", msg.From.Username)
-		b.maybeSendMessage("You are not allowed to use this bot")
+	pending := b.maybeSendPendingMessage()
+	bookmark, err := b.linkService.Refresh(b.ctx, url)
+	if errorx.HasTrait(err, errorx.NotFound()) {
+		b.finishPendingMessage(pending, b.escape("Not found"))
 		return
 	}
-
-	log.Debugf("Received message: %v", msg)
-
-	urls := b.urlExtractor(msg)
-	if len(urls) == 0 {
-		log.Debug("No URLs found")
-		b.maybeSendMessage("No URLs found in the message")
+	if err != nil {
+		b.logger().WithField("url", logUrl(url, b.options.RedactUrlsInLogs)).Debugf("Couldn't refresh a bookmark: %+v", err)
+		b.finishPendingMessage(pending, b.escape("Error"))
+		return
+	}
+	if bookmark.Title == "" {
+		b.finishPendingMessage(pending, b.escape("Refreshed"))
 		return
 	}
+	b.finishPendingMessage(pending, b.escape(fmt.Sprintf("Refreshed: %s", bookmark.Title)))
+}
 
-	firstUrl := urls[0]
-	err := b.linkService.Save(firstUrl)
+// saveNote saves the text of the message as a note. Linkding requires every bookmark to have a URL, so the note gets
+// the one of notePlaceholderUrl
+func (b *bot) saveNote(msg *echotron.Message, text string) {
+	options := b.chatSettings.Get(b.chatId).apply(&SaveOptions{
+		TagNames: b.tagExtractor(msg),
+		Notes:    b.dateNote(msg),
+	})
+	placeholderUrl := notePlaceholderUrl(msg)
+	pending := b.maybeSendPendingMessage()
+	bookmark, err := b.linkService.SaveNote(b.ctx, placeholderUrl, text, options)
 	if err != nil {
-		log.Debugf("Couldn't save a link: %+v", err)
-		b.maybeSendMessage("Error")
+		b.logger().Debugf("Couldn't save a note: %+v", err)
+		b.finishPendingMessage(pending, b.escape("Error"))
 		return
 	}
-	b.maybeSendMessage("Saved!")
+	if bookmark != nil {
+		b.lastSaved.Set(b.chatId, msg.From, bookmark)
+	}
+	b.finishPendingMessage(pending, b.escape("Saved as a note!"))
+}
+
+// notePlaceholderUrl returns the t.me link of the message for supergroups and channels, the only chats whose
+// messages have one. Private and basic group chats get an opaque URL that doesn't open anything but is unique to
+// the message, so notes don't collide as duplicates
+func notePlaceholderUrl(msg *echotron.Message) string {
+	if msg.Chat.Type == "supergroup" || msg.Chat.Type == "channel" {
+		if msg.Chat.Username != "" {
+			return fmt.Sprintf("https://t.me/%s/%d", msg.Chat.Username, msg.ID)
+		}
+		// private links use the chat ID without the -100 prefix of supergroup and channel IDs
+		if id, isChannelId := strings.CutPrefix(strconv.FormatInt(msg.Chat.ID, 10), "-100"); isChannelId {
+			return fmt.Sprintf("https://t.me/c/%s/%d", id, msg.ID)
+		}
+	}
+	return fmt.Sprintf("https://t.me/#note/%d/%d", msg.Chat.ID, msg.ID)
+}
+
+// documentNote describes a document message, the file name first as it becomes the note title
+func documentNote(msg *echotron.Message) string {
+	name := msg.Document.FileName
+	if name == "" {
+		name = "Document"
+	}
+	return joinNotes(name, msg.Caption)
 }
 
 type BotFactory interface {
@@ -300,47 +3369,214 @@ type BotFactory interface {
 }
 
 type botFactory struct {
-	tgToken          string
-	allowedUsernames []string
-	api              echotron.API
-	urlExtractor     UrlExtractor
-	linkService      LinkService
+	tgToken       string
+	allowlist     *Allowlist
+	api           TelegramApi
+	urlExtractors []UrlExtractor
+	tagExtractor  TagExtractor
+	linkService   LinkService
+	lastSaved     *lastSavedTracker
+	nextTags      *nextTagsTracker
+	recentSaves   *recentSaves
+	chatSettings  *chatSettingsStore
+	auditLog      AuditLog
+	options       BotOptions
 }
 
 func NewBotFactory(
 	tgToken string,
-	allowedUsernames []string,
-	urlExtractor UrlExtractor,
+	allowlist *Allowlist,
+	urlExtractors []UrlExtractor,
+	tagExtractor TagExtractor,
 	linkService LinkService,
-	api echotron.API,
+	auditLog AuditLog,
+	options BotOptions,
+	api TelegramApi,
 ) BotFactory {
 	return &botFactory{
-		tgToken:          tgToken,
-		allowedUsernames: allowedUsernames,
-		urlExtractor:     urlExtractor,
-		linkService:      linkService,
-		api:              api,
+		tgToken:       tgToken,
+		allowlist:     allowlist,
+		urlExtractors: urlExtractors,
+		tagExtractor:  tagExtractor,
+		linkService:   linkService,
+		lastSaved:     newLastSavedTracker(),
+		nextTags:      newNextTagsTracker(),
+		recentSaves:   newRecentSaves(options.RecentSaveTtl, options.UrlNormalization),
+		chatSettings:  newChatSettingsStore(),
+		auditLog:      auditLog,
+		options:       options,
+		api:           api,
 	}
 }
 
 func (b *botFactory) NewBot() echotron.NewBotFn {
 	return func(chatId int64) echotron.Bot {
 		return &bot{
-			chatId:           chatId,
-			allowedUsernames: b.allowedUsernames,
-			urlExtractor:     b.urlExtractor,
-			linkService:      b.linkService,
-			API:              b.api,
+			chatId:        chatId,
+			allowlist:     b.allowlist,
+			urlExtractors: b.urlExtractors,
+			tagExtractor:  b.tagExtractor,
+			linkService:   b.linkService,
+			lastSaved:     b.lastSaved,
+			nextTags:      b.nextTags,
+			recentSaves:   b.recentSaves,
+			chatSettings:  b.chatSettings,
+			batch:         &updateBatch{},
+			auditLog:      b.auditLog,
+			options:       b.options,
+			TelegramApi:   b.api,
+		}
+	}
+}
+
+const (
+	TelegramSecretTokenHeader   = "X-Telegram-Bot-Api-Secret-Token"
+	DefaultWebhookListenAddress = ":8080"
+	// webhookReadHeaderTimeout keeps clients that send their headers slowly from holding connections open
+	webhookReadHeaderTimeout = 10 * time.Second
+)
+
+var webhookSecretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// NewWebhookHandler wraps the dispatcher's webhook handler, rejecting updates without the expected secret token
+func NewWebhookHandler(secret string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(TelegramSecretTokenHeader)
+		if secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			log.Warnf("Rejected webhook request from %s: secret token mismatch", r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
 		}
+		next(w, r)
+	})
+}
+
+// newWebhookMux routes POST requests to the exact path to the handler, other methods get 405 and other paths 404
+func newWebhookMux(path string, handler http.Handler) *http.ServeMux {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	// a trailing slash would match every path under it otherwise
+	if strings.HasSuffix(path, "/") {
+		path += "{$}"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("POST "+path, handler)
+	return mux
+}
+
+func listenWebhook(api echotron.API, dsp *echotron.Dispatcher, config *envConfig) error {
+	webhookUrl, err := url.Parse(config.WebhookUrl)
+	if err != nil {
+		return errorx.Decorate(err, "failed to parse webhook URL")
+	}
+	if config.WebhookSecret == "" {
+		log.Warn("WEBHOOK_SECRET isn't set, anyone who finds the webhook URL can send the bot updates")
+	}
+
+	_, err = api.SetWebhook(config.WebhookUrl, false, &echotron.WebhookOptions{
+		SecretToken: config.WebhookSecret,
+	})
+	if err != nil {
+		return errorx.Decorate(err, "failed to set webhook")
+	}
+	log.Printf("Webhook set to %s", webhookUrl.Redacted())
+
+	// behind a reverse proxy the public path may differ from the one the bot listens on
+	path := config.WebhookPath
+	if path == "" {
+		path = webhookUrl.Path
 	}
+	mux := newWebhookMux(path, NewWebhookHandler(config.WebhookSecret, dsp.HandleWebhook))
+
+	address := config.WebhookListenAddress
+	if address == "" {
+		address = DefaultWebhookListenAddress
+	}
+	log.Printf("Listening for webhook updates on %s", address)
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: webhookReadHeaderTimeout}
+	return server.ListenAndServe()
 }
 
 type envConfig struct {
-	Token            string   `mapstructure:"TOKEN"`
-	AllowedUsernames []string `mapstructure:"ALLOWED_USERNAMES"`
-	LinkdingBaseUrl  string   `mapstructure:"LINKDING_BASE_URL"`
-	LinkdingApiToken string   `mapstructure:"LINKDING_API_TOKEN"`
-	DebugLogging     bool     `mapstructure:"DEBUG_LOGGING"`
+	Token                     string        `mapstructure:"TOKEN"`
+	AllowedUsernames          []string      `mapstructure:"ALLOWED_USERNAMES"`
+	LinkdingBaseUrl           string        `mapstructure:"LINKDING_BASE_URL"`
+	LinkdingApiToken          string        `mapstructure:"LINKDING_API_TOKEN"`
+	LinkdingApiTokenFile      string        `mapstructure:"LINKDING_API_TOKEN_FILE"`
+	LinkdingExtraHeaders      []string      `mapstructure:"LINKDING_EXTRA_HEADERS"`
+	LinkdingRateLimitHeaders  []string      `mapstructure:"LINKDING_RATE_LIMIT_HEADERS"`
+	LinkdingBookmarksPath     string        `mapstructure:"LINKDING_BOOKMARKS_PATH"`
+	DebugLogging              bool          `mapstructure:"DEBUG_LOGGING"`
+	LogLevel                  string        `mapstructure:"LOG_LEVEL"`
+	LogReportCaller           bool          `mapstructure:"LOG_REPORT_CALLER"`
+	RedactUrlsInLogs          bool          `mapstructure:"REDACT_URLS_IN_LOGS"`
+	LogSuppressionWindow      time.Duration `mapstructure:"LOG_SUPPRESSION_WINDOW"`
+	NormalizeStripWww         bool          `mapstructure:"NORMALIZE_STRIP_WWW"`
+	NormalizeForceHttps       bool          `mapstructure:"NORMALIZE_FORCE_HTTPS"`
+	TagMentions               bool          `mapstructure:"TAG_MENTIONS"`
+	FavoriteTag               string        `mapstructure:"FAVORITE_TAG"`
+	ReviewTag                 string        `mapstructure:"REVIEW_TAG"`
+	TagAliases                []string      `mapstructure:"TAG_ALIASES"`
+	DateTag                   bool          `mapstructure:"DATE_TAG"`
+	DateNote                  bool          `mapstructure:"DATE_NOTE"`
+	PageInfoCacheTtl          time.Duration `mapstructure:"PAGE_INFO_CACHE_TTL"`
+	SaveTextNotes             bool          `mapstructure:"SAVE_TEXT_NOTES"`
+	SaveDocuments             bool          `mapstructure:"SAVE_DOCUMENTS"`
+	ReplyOnNoUrls             bool          `mapstructure:"REPLY_ON_NO_URLS"`
+	ReactionReplies           bool          `mapstructure:"REACTION_REPLIES"`
+	AllowedSchemes            []string      `mapstructure:"ALLOWED_SCHEMES"`
+	MaxUrlsPerMessage         int           `mapstructure:"MAX_URLS_PER_MESSAGE"`
+	TimeWindows               []string      `mapstructure:"TIME_WINDOWS"`
+	TimeWindowsTimezone       string        `mapstructure:"TIME_WINDOWS_TIMEZONE"`
+	FetchDomainDelayMs        int           `mapstructure:"FETCH_DOMAIN_DELAY_MS"`
+	WebhookUrl                string        `mapstructure:"WEBHOOK_URL"`
+	WebhookListenAddress      string        `mapstructure:"WEBHOOK_LISTEN_ADDRESS"`
+	WebhookPath               string        `mapstructure:"WEBHOOK_PATH"`
+	WebhookSecret             string        `mapstructure:"WEBHOOK_SECRET"`
+	AutoArchiveDomains        []string      `mapstructure:"AUTO_ARCHIVE_DOMAINS"`
+	ReadDomains               []string      `mapstructure:"READ_DOMAINS"`
+	SavePageText              bool          `mapstructure:"SAVE_PAGE_TEXT"`
+	PageTextMaxLength         int           `mapstructure:"PAGE_TEXT_MAX_LENGTH"`
+	HttpMaxIdleConns          int           `mapstructure:"HTTP_MAX_IDLE_CONNS"`
+	HttpMaxIdleConnsPerHost   int           `mapstructure:"HTTP_MAX_IDLE_CONNS_PER_HOST"`
+	HttpIdleConnTimeout       time.Duration `mapstructure:"HTTP_IDLE_CONN_TIMEOUT"`
+	HttpDisableKeepAlives     bool          `mapstructure:"HTTP_DISABLE_KEEP_ALIVES"`
+	HttpResponseHeaderTimeout time.Duration `mapstructure:"HTTP_RESPONSE_HEADER_TIMEOUT"`
+	HttpTimeoutSeconds        int           `mapstructure:"HTTP_TIMEOUT_SECONDS"`
+	FetchTimeoutSeconds       int           `mapstructure:"FETCH_TIMEOUT_SECONDS"`
+	LinkdingTimeoutSeconds    int           `mapstructure:"LINKDING_TIMEOUT_SECONDS"`
+	WaitForLinkdingSeconds    int           `mapstructure:"WAIT_FOR_LINKDING_SECONDS"`
+	BlockPrivateIps           bool          `mapstructure:"BLOCK_PRIVATE_IPS"`
+	FetchIpPreference         string        `mapstructure:"FETCH_IP_PREFERENCE"`
+	FetchProxyUrl             string        `mapstructure:"FETCH_PROXY_URL"`
+	FetchMaxRedirects         int           `mapstructure:"FETCH_MAX_REDIRECTS"`
+	TlsMinVersion             string        `mapstructure:"TLS_MIN_VERSION"`
+	TlsCipherSuites           []string      `mapstructure:"TLS_CIPHER_SUITES"`
+	ReplyParseMode            string        `mapstructure:"REPLY_PARSE_MODE"`
+	OptimisticReply           bool          `mapstructure:"OPTIMISTIC_REPLY"`
+	DisableReplyPreview       bool          `mapstructure:"DISABLE_REPLY_PREVIEW"`
+	ShowLatency               bool          `mapstructure:"SHOW_LATENCY"`
+	AllowlistFile             string        `mapstructure:"ALLOWLIST_FILE"`
+	AdminUsernames            []string      `mapstructure:"ADMIN_USERNAMES"`
+	AuditLogPath              string        `mapstructure:"AUDIT_LOG_PATH"`
+	MaxUrlLength              int           `mapstructure:"MAX_URL_LENGTH"`
+	FetchDomainOverrides      []string      `mapstructure:"FETCH_DOMAIN_OVERRIDES"`
+	SavePreviewImage          bool          `mapstructure:"SAVE_PREVIEW_IMAGE"`
+	SaveSourceNote            bool          `mapstructure:"SAVE_SOURCE_NOTE"`
+	SaveCaptionUrls           bool          `mapstructure:"SAVE_CAPTION_URLS"`
+	RecentSaveTtl             time.Duration `mapstructure:"RECENT_SAVE_TTL"`
+	BatchWindow               time.Duration `mapstructure:"BATCH_WINDOW"`
+	SaveOnFetchFailure        bool          `mapstructure:"SAVE_ON_FETCH_FAILURE"`
+	FetchFailureTag           string        `mapstructure:"FETCH_FAILURE_TAG"`
+	TitleStripSuffixes        []string      `mapstructure:"TITLE_STRIP_SUFFIXES"`
+	TitleFromUrlFallback      bool          `mapstructure:"TITLE_FROM_URL_FALLBACK"`
+	LinkdingScrapeFallback    bool          `mapstructure:"LINKDING_SCRAPE_FALLBACK"`
+	LinkdingTargetList        string        `mapstructure:"LINKDING_TARGET_LIST"`
+	AllowedChatTypes          []string      `mapstructure:"ALLOWED_CHAT_TYPES"`
+	SilentChatTypeRejection   bool          `mapstructure:"SILENT_CHAT_TYPE_REJECTION"`
+	ArchiveAfterDays          int           `mapstructure:"ARCHIVE_AFTER_DAYS"`
+	ArchiveAfterTag           string        `mapstructure:"ARCHIVE_AFTER_TAG"`
 }
 
 func parseConfig(i interface{}) error {
@@ -363,6 +3599,25 @@ func loadEnvVariables() *envConfig {
 	viper.SetConfigType("env")
 	viper.SetEnvPrefix("ltr")
 	viper.AutomaticEnv()
+	viper.SetDefault("BLOCK_PRIVATE_IPS", true)
+	viper.SetDefault("DISABLE_REPLY_PREVIEW", true)
+	viper.SetDefault("SAVE_CAPTION_URLS", true)
+	viper.SetDefault("REPLY_ON_NO_URLS", true)
+	viper.SetDefault("ALLOWED_SCHEMES", DefaultAllowedSchemes)
+	viper.SetDefault("MAX_URLS_PER_MESSAGE", DefaultMaxUrlsPerMessage)
+	viper.SetDefault("TITLE_FROM_URL_FALLBACK", true)
+	viper.SetDefault("MAX_URL_LENGTH", DefaultMaxUrlLength)
+	viper.SetDefault("HTTP_TIMEOUT_SECONDS", DefaultHttpTimeoutSeconds)
+	viper.SetDefault("LINKDING_RATE_LIMIT_HEADERS", DefaultRateLimitHeaders)
+	viper.SetDefault("FAVORITE_TAG", "favorite")
+	viper.SetDefault("REVIEW_TAG", "review")
+	viper.SetDefault("ARCHIVE_AFTER_TAG", "telegram")
+	viper.SetDefault("TLS_MIN_VERSION", DefaultTlsMinVersion)
+	viper.SetDefault("HTTP_MAX_IDLE_CONNS", DefaultMaxIdleConns)
+	viper.SetDefault("HTTP_MAX_IDLE_CONNS_PER_HOST", DefaultMaxIdleConnsPerHost)
+	viper.SetDefault("HTTP_IDLE_CONN_TIMEOUT", DefaultIdleConnTimeout)
+	viper.SetDefault("RECENT_SAVE_TTL", DefaultRecentSaveTtl)
+	viper.SetDefault("LOG_SUPPRESSION_WINDOW", DefaultErrorLogWindow)
 	if err := viper.ReadInConfig(); err != nil {
 		log.Fatalf("%+v", errorx.Decorate(err, "failed to read config"))
 	}
@@ -373,62 +3628,405 @@ func loadEnvVariables() *envConfig {
 	return config
 }
 
+// parseLogLevel parses a logrus level name like "warn", failing with the accepted names otherwise
+func parseLogLevel(level string) (log.Level, error) {
+	parsed, err := log.ParseLevel(strings.TrimSpace(level))
+	if err != nil {
+		names := make([]string, 0, len(log.AllLevels))
+		for _, l := range log.AllLevels {
+			names = append(names, l.String())
+		}
+		return 0, errorx.IllegalArgument.New("unknown log level %q, expected one of %v", level, names)
+	}
+	return parsed, nil
+}
+
+// DefaultHttpTimeoutSeconds applies to both page fetches and linkding calls unless they have their own timeouts
+const DefaultHttpTimeoutSeconds = 30
+
+// timeoutOrDefault returns the timeout in seconds as a duration, falling back to the default when it isn't set
+func timeoutOrDefault(seconds, defaultSeconds int) time.Duration {
+	if seconds == 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// chatTypes are the chat types ALLOWED_CHAT_TYPES accepts, channels are missing as their posts arrive as
+// channel_post updates, which the bot doesn't handle
+var chatTypes = []string{"private", "group", "supergroup"}
+
 func validateConfig(config *envConfig) error {
 	if config.Token == "" {
 		return errorx.IllegalArgument.New("env TOKEN is required")
 	}
-	if len(config.AllowedUsernames) == 0 {
-		return errorx.IllegalArgument.New("at least one allowed username is required (env ALLOWED_USERNAMES)")
+	if len(config.AllowedUsernames) == 0 && config.AllowlistFile == "" {
+		return errorx.IllegalArgument.New("at least one allowed username is required (env ALLOWED_USERNAMES or ALLOWLIST_FILE)")
 	}
-	if config.LinkdingApiToken == "" {
-		return errorx.IllegalArgument.New("env LINKDING_API_TOKEN is required")
+	if _, err := ParseUserSet(config.AllowedUsernames); err != nil {
+		return errorx.Decorate(err, "env ALLOWED_USERNAMES is invalid")
+	}
+	if _, err := ParseUserSet(config.AdminUsernames); err != nil {
+		return errorx.Decorate(err, "env ADMIN_USERNAMES is invalid")
+	}
+	if config.LinkdingApiToken == "" && config.LinkdingApiTokenFile == "" {
+		return errorx.IllegalArgument.New("env LINKDING_API_TOKEN or LINKDING_API_TOKEN_FILE is required")
 	}
 	if config.LinkdingBaseUrl == "" {
 		return errorx.IllegalArgument.New("env LINKDING_BASE_URL is required")
 	}
+	if config.FetchDomainDelayMs < 0 {
+		return errorx.IllegalArgument.New("env FETCH_DOMAIN_DELAY_MS must not be negative")
+	}
+	if config.PageTextMaxLength < 0 {
+		return errorx.IllegalArgument.New("env PAGE_TEXT_MAX_LENGTH must not be negative")
+	}
+	if config.MaxUrlLength < 0 {
+		return errorx.IllegalArgument.New("env MAX_URL_LENGTH must not be negative")
+	}
+	if config.MaxUrlsPerMessage < 0 {
+		return errorx.IllegalArgument.New("env MAX_URLS_PER_MESSAGE must not be negative")
+	}
+	if config.BatchWindow < 0 {
+		return errorx.IllegalArgument.New("env BATCH_WINDOW must not be negative")
+	}
+	if config.RecentSaveTtl < 0 {
+		return errorx.IllegalArgument.New("env RECENT_SAVE_TTL must not be negative")
+	}
+	if config.LogSuppressionWindow < 0 {
+		return errorx.IllegalArgument.New("env LOG_SUPPRESSION_WINDOW must not be negative")
+	}
+	if config.HttpMaxIdleConns < 0 {
+		return errorx.IllegalArgument.New("env HTTP_MAX_IDLE_CONNS must not be negative")
+	}
+	if config.HttpMaxIdleConnsPerHost < 0 {
+		return errorx.IllegalArgument.New("env HTTP_MAX_IDLE_CONNS_PER_HOST must not be negative")
+	}
+	if config.HttpIdleConnTimeout < 0 {
+		return errorx.IllegalArgument.New("env HTTP_IDLE_CONN_TIMEOUT must not be negative")
+	}
+	if config.HttpTimeoutSeconds < 0 || config.FetchTimeoutSeconds < 0 || config.LinkdingTimeoutSeconds < 0 {
+		return errorx.IllegalArgument.New(
+			"envs HTTP_TIMEOUT_SECONDS, FETCH_TIMEOUT_SECONDS and LINKDING_TIMEOUT_SECONDS must not be negative")
+	}
+	if config.ArchiveAfterDays < 0 {
+		return errorx.IllegalArgument.New("env ARCHIVE_AFTER_DAYS must not be negative")
+	}
+	if config.ArchiveAfterDays > 0 && sanitizeTag(config.ArchiveAfterTag) == "" {
+		return errorx.IllegalArgument.New("env ARCHIVE_AFTER_TAG is required when ARCHIVE_AFTER_DAYS is set")
+	}
+	if config.FetchMaxRedirects < 0 {
+		return errorx.IllegalArgument.New("env FETCH_MAX_REDIRECTS must not be negative")
+	}
+	if config.WaitForLinkdingSeconds < 0 {
+		return errorx.IllegalArgument.New("env WAIT_FOR_LINKDING_SECONDS must not be negative")
+	}
+	if config.HttpResponseHeaderTimeout < 0 {
+		return errorx.IllegalArgument.New("env HTTP_RESPONSE_HEADER_TIMEOUT must not be negative")
+	}
+	if _, err := parseTimeWindows(config.TimeWindows); err != nil {
+		return errorx.Decorate(err, "env TIME_WINDOWS is invalid")
+	}
+	if _, err := time.LoadLocation(config.TimeWindowsTimezone); err != nil {
+		return errorx.Decorate(err, "env TIME_WINDOWS_TIMEZONE is invalid")
+	}
+	if _, err := parseTagAliases(config.TagAliases); err != nil {
+		return errorx.Decorate(err, "env TAG_ALIASES is invalid")
+	}
+	if _, err := parseParseMode(config.ReplyParseMode); err != nil {
+		return errorx.Decorate(err, "env REPLY_PARSE_MODE is invalid")
+	}
+	for _, chatType := range config.AllowedChatTypes {
+		if !contains(chatTypes, chatType) {
+			return errorx.IllegalArgument.New("env ALLOWED_CHAT_TYPES contains unknown chat type %q, expected one of %v",
+				chatType, chatTypes)
+		}
+	}
+	if _, err := parseTlsVersion(config.TlsMinVersion); err != nil {
+		return errorx.Decorate(err, "env TLS_MIN_VERSION is invalid")
+	}
+	if _, err := parseTlsCipherSuites(config.TlsCipherSuites); err != nil {
+		return errorx.Decorate(err, "env TLS_CIPHER_SUITES is invalid")
+	}
+	if _, err := parseProxyUrl(config.FetchProxyUrl); err != nil {
+		return errorx.Decorate(err, "env FETCH_PROXY_URL is invalid")
+	}
+	switch config.FetchIpPreference {
+	case "", IpPreferenceAuto, IpPreferenceIpv4, IpPreferenceIpv6:
+	default:
+		return errorx.IllegalArgument.New("env FETCH_IP_PREFERENCE must be auto, ipv4 or ipv6")
+	}
+	if config.WebhookPath != "" && (!strings.HasPrefix(config.WebhookPath, "/") ||
+		strings.ContainsAny(config.WebhookPath, "{} ")) {
+		return errorx.IllegalArgument.New("env WEBHOOK_PATH must start with / and can't contain braces or spaces")
+	}
+	if config.WebhookSecret != "" && !webhookSecretPattern.MatchString(config.WebhookSecret) {
+		return errorx.IllegalArgument.New("env WEBHOOK_SECRET must be 1-256 characters of A-Z, a-z, 0-9, _ and -")
+	}
 	return nil
 }
 
 func main() {
 	log.SetOutput(os.Stdout)
 	config := loadEnvVariables()
+	// LOG_LEVEL takes precedence over DEBUG_LOGGING, which is kept for existing deployments
 	if config.DebugLogging {
 		log.SetLevel(log.DebugLevel)
 	}
+	if config.LogLevel != "" {
+		level, err := parseLogLevel(config.LogLevel)
+		if err != nil {
+			log.Fatalf("%+v", errorx.Decorate(err, "env LOG_LEVEL is invalid"))
+		}
+		log.SetLevel(level)
+	}
+	// adds file:line to every entry, off by default as it walks the stack on every log call
+	log.SetReportCaller(config.LogReportCaller)
 	err := validateConfig(config)
 	if err != nil {
 		log.Fatalf("%+v", errorx.Decorate(err, "config validation failed"))
 	}
 	log.Println("Config loaded successfully")
-	log.Printf("Allowed usernames: %v", config.AllowedUsernames)
+	// applied both for saving and for deduplicating URLs, so they have to be the same everywhere
+	urlNormalization := UrlNormalization{
+		StripWww:   config.NormalizeStripWww,
+		ForceHttps: config.NormalizeForceHttps,
+	}
+	allowedUsers, err := loadAllowlist(config)
+	if err != nil {
+		log.Fatalf("%+v", errorx.Decorate(err, "failed to load allowlist"))
+	}
+	log.Printf("Allowed users: %v", allowedUsers)
+	allowlist := NewAllowlist(allowedUsers)
+	if config.AllowlistFile != "" {
+		reloadAllowlistOnSighup(allowlist, config)
+	}
 
 	api := echotron.NewAPI(config.Token)
 
-	res, err := api.GetMe()
+	res, err := getMeWithRetry(api, getMeAttempts)
 	if err != nil {
 		log.Fatalf("%+v", errorx.Decorate(err, "failed to get bot info"))
 	}
 	log.Printf("Bot username: @%s", res.Result.Username)
 
-	linkdingRepository := NewLinkdingRepository(config.LinkdingBaseUrl, config.LinkdingApiToken)
-	pageInfoService := NewPageInfoService()
-	linkService := NewLinkdingLinkService(linkdingRepository, pageInfoService)
-	urlExtractor := GetUrlsWithExtractors(GetUrlsFromLinkPreview, GetUrlsFromEntities)
+	extraHeaders, err := parseHeaders(config.LinkdingExtraHeaders)
+	if err != nil {
+		log.Fatalf("%+v", errorx.Decorate(err, "failed to parse LINKDING_EXTRA_HEADERS"))
+	}
+	if extraHeaders.Get("Authorization") != "" {
+		log.Warn("LINKDING_EXTRA_HEADERS overrides the Authorization header, LINKDING_API_TOKEN won't be sent")
+	}
+
+	fetchOverrides, err := parseFetchOverrides(config.FetchDomainOverrides)
+	if err != nil {
+		log.Fatalf("%+v", errorx.Decorate(err, "failed to parse FETCH_DOMAIN_OVERRIDES"))
+	}
+
+	// already validated
+	tlsMinVersion, _ := parseTlsVersion(config.TlsMinVersion)
+	tlsCipherSuites, _ := parseTlsCipherSuites(config.TlsCipherSuites)
+	transportOptions := TransportOptions{
+		MaxIdleConns:          config.HttpMaxIdleConns,
+		MaxIdleConnsPerHost:   config.HttpMaxIdleConnsPerHost,
+		IdleConnTimeout:       config.HttpIdleConnTimeout,
+		DisableKeepAlives:     config.HttpDisableKeepAlives,
+		ResponseHeaderTimeout: config.HttpResponseHeaderTimeout,
+		TlsMinVersion:         tlsMinVersion,
+		TlsCipherSuites:       tlsCipherSuites,
+	}
+	linkdingTransportOptions := transportOptions
+	linkdingTransportOptions.Timeout = timeoutOrDefault(config.LinkdingTimeoutSeconds, config.HttpTimeoutSeconds)
+	linkdingApiToken, err := loadLinkdingApiToken(config)
+	if err != nil {
+		log.Fatalf("%+v", errorx.Decorate(err, "failed to load linkding API token"))
+	}
+	linkdingRepository := NewLinkdingRepository(
+		config.LinkdingBaseUrl,
+		linkdingApiToken,
+		NewHttpClient(linkdingTransportOptions),
+		LinkdingRepositoryOptions{
+			ExtraHeaders:     extraHeaders,
+			RateLimitHeaders: config.LinkdingRateLimitHeaders,
+			BookmarksPath:    config.LinkdingBookmarksPath,
+			ErrorLogWindow:   config.LogSuppressionWindow,
+			RedactUrlsInLogs: config.RedactUrlsInLogs,
+		},
+	)
+	reloadLinkdingApiTokenOnSighup(linkdingRepository, config)
+	if config.WaitForLinkdingSeconds > 0 {
+		timeout := time.Duration(config.WaitForLinkdingSeconds) * time.Second
+		if err = waitForLinkding(linkdingRepository, timeout); err != nil {
+			log.Fatalf("%+v", errorx.Decorate(err, "failed to reach linkding"))
+		}
+		log.Println("Linkding is available")
+	}
+	// linkding itself commonly runs on a private network, so only page fetches are restricted
+	fetchTransportOptions := transportOptions
+	fetchTransportOptions.BlockPrivateIps = config.BlockPrivateIps
+	fetchTransportOptions.IpPreference = config.FetchIpPreference
+	fetchTransportOptions.MaxRedirects = config.FetchMaxRedirects
+	// already validated
+	fetchTransportOptions.Proxy, _ = parseProxyUrl(config.FetchProxyUrl)
+	if fetchTransportOptions.Proxy != nil && config.BlockPrivateIps {
+		log.Warn("BLOCK_PRIVATE_IPS doesn't apply to page fetches through FETCH_PROXY_URL, the proxy connects to the pages")
+	}
+	pageInfoService := NewPageInfoService(NewHttpClient(fetchTransportOptions), PageInfoServiceOptions{
+		DomainDelay:         time.Duration(config.FetchDomainDelayMs) * time.Millisecond,
+		Timeout:             timeoutOrDefault(config.FetchTimeoutSeconds, config.HttpTimeoutSeconds),
+		ExtractText:         config.SavePageText,
+		TextMaxLength:       config.PageTextMaxLength,
+		FetchOverrides:      fetchOverrides,
+		ExtractPreviewImage: config.SavePreviewImage,
+		RedactUrlsInLogs:    config.RedactUrlsInLogs,
+	})
+	if config.PageInfoCacheTtl > 0 {
+		pageInfoService = NewCachingPageInfoService(pageInfoService, config.PageInfoCacheTtl)
+	}
+	// the relay only archives bookmarks it saved itself, which it recognizes by the tag
+	relayTag := ""
+	if config.ArchiveAfterDays > 0 {
+		relayTag = sanitizeTag(config.ArchiveAfterTag)
+	}
+	linkService := NewLinkdingLinkService(
+		linkdingRepository,
+		pageInfoService,
+		LinkServiceOptions{
+			AutoArchiveDomains:     config.AutoArchiveDomains,
+			ReadDomains:            config.ReadDomains,
+			MaxUrlLength:           config.MaxUrlLength,
+			SaveOnFetchFailure:     config.SaveOnFetchFailure,
+			FetchFailureTag:        sanitizeTag(config.FetchFailureTag),
+			TitleStripSuffixes:     config.TitleStripSuffixes,
+			TitleFromUrlFallback:   config.TitleFromUrlFallback,
+			LinkdingScrapeFallback: config.LinkdingScrapeFallback,
+			SourceNote:             config.SaveSourceNote,
+			TargetList:             config.LinkdingTargetList,
+			RelayTag:               relayTag,
+			UrlNormalization:       urlNormalization,
+			RedactUrlsInLogs:       config.RedactUrlsInLogs,
+		},
+	)
+	if config.ArchiveAfterDays > 0 {
+		archiveStaleBookmarks(linkService, relayTag, time.Duration(config.ArchiveAfterDays)*24*time.Hour)
+	}
+	urlExtractors := NewUrlExtractors(config.SaveCaptionUrls)
+	// already validated
+	timeWindowsLocation, _ := time.LoadLocation(config.TimeWindowsTimezone)
+	tagExtractors := make([]TagExtractor, 0)
+	if config.TagMentions {
+		tagExtractors = append(tagExtractors, GetTagsFromMentions)
+	}
+	if config.DateTag {
+		tagExtractors = append(tagExtractors, GetDateTag(timeWindowsLocation))
+	}
+	if favoriteTag := sanitizeTag(config.FavoriteTag); favoriteTag != "" {
+		tagExtractors = append(tagExtractors, GetFavoriteTag(favoriteTag))
+	}
+	if len(config.TagAliases) > 0 {
+		// already validated
+		tagAliases, _ := parseTagAliases(config.TagAliases)
+		tagExtractors = append(tagExtractors, GetTagsFromAliases(tagAliases))
+	}
+	tagExtractor := GetTagsWithExtractors(tagExtractors...)
+	// already validated
+	parseMode, _ := parseParseMode(config.ReplyParseMode)
+	admins, _ := ParseUserSet(config.AdminUsernames)
+	timeWindows, _ := parseTimeWindows(config.TimeWindows)
+	auditLog, err := NewFileAuditLog(config.AuditLogPath)
+	if err != nil {
+		log.Fatalf("%+v", errorx.Decorate(err, "failed to open AUDIT_LOG_PATH"))
+	}
 	botFactory := NewBotFactory(
 		config.Token,
-		config.AllowedUsernames,
-		urlExtractor,
+		allowlist,
+		urlExtractors,
+		tagExtractor,
 		linkService,
+		auditLog,
+		BotOptions{
+			SaveTextNotes:           config.SaveTextNotes,
+			SaveDocuments:           config.SaveDocuments,
+			ReplyOnNoUrls:           config.ReplyOnNoUrls,
+			ReactionReplies:         config.ReactionReplies,
+			Username:                res.Result.Username,
+			AllowedSchemes:          normalizeSchemes(config.AllowedSchemes),
+			ReviewTag:               sanitizeTag(config.ReviewTag),
+			MaxUrlsPerMessage:       config.MaxUrlsPerMessage,
+			TimeWindows:             timeWindows,
+			TimeWindowsLocation:     timeWindowsLocation,
+			ParseMode:               parseMode,
+			OptimisticReply:         config.OptimisticReply,
+			DisableReplyPreview:     config.DisableReplyPreview,
+			ShowLatency:             config.ShowLatency,
+			DateNote:                config.DateNote,
+			RecentSaveTtl:           config.RecentSaveTtl,
+			BatchWindow:             config.BatchWindow,
+			Admins:                  admins,
+			AllowedChatTypes:        config.AllowedChatTypes,
+			SilentChatTypeRejection: config.SilentChatTypeRejection,
+			UrlNormalization:        urlNormalization,
+			RedactUrlsInLogs:        config.RedactUrlsInLogs,
+		},
 		api,
 	)
 
 	dsp := echotron.NewDispatcher(config.Token, botFactory.NewBot())
 	log.Println("Dispatcher constructed")
 
+	if config.WebhookUrl != "" {
+		log.Fatalf("%+v", errorx.Decorate(listenWebhook(api, dsp, config), "webhook server failed"))
+	}
+
 	for {
-		log.Println("Polling...")
-		log.Println(dsp.Poll())
+		time.Sleep(poll(dsp.Poll))
+	}
+}
+
+// pollRetryDelay is how long the bot waits before polling again after polling stopped
+const pollRetryDelay = 5 * time.Second
+
+// poll runs the poll loop until it stops, logs why it stopped and returns how long to wait before polling again
+func poll(run func() error) time.Duration {
+	log.Debug("Polling...")
+	err := run()
+	if isPollConflict(err) {
+		log.Errorf("Another instance is running with the same bot token, stop it or use another token. "+
+			"Retrying in %s: %v", pollConflictBackoff, err)
+		return pollConflictBackoff
+	}
+	if err != nil {
+		log.Errorf("Polling stopped, restarting: %v", err)
+	}
+	return pollRetryDelay
+}
 
-		time.Sleep(5 * time.Second)
+// getMeAttempts spans about half a minute of backoff, enough for a network that is still coming up
+const getMeAttempts = 6
+
+// getMeWithRetry calls GetMe until it succeeds, backing off between attempts, and fails after the last attempt
+func getMeWithRetry(api echotron.API, attempts int) (echotron.APIResponseUser, error) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		res, err := api.GetMe()
+		if err == nil {
+			return res, nil
+		}
+		if attempt >= attempts {
+			return res, errorx.Decorate(err, "GetMe failed %d times", attempts)
+		}
+		log.Printf("Getting bot info failed, attempt %d of %d, retrying in %s: %v", attempt, attempts, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
 	}
 }
+
+// pollConflictBackoff is longer than the usual poll retry, as the other instance rarely goes away within seconds
+const pollConflictBackoff = time.Minute
+
+// isPollConflict reports whether getUpdates failed with 409 Conflict, which Telegram returns while another instance
+// polls with the same token
+func isPollConflict(err error) bool {
+	var apiErr interface{ ErrorCode() int }
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == http.StatusConflict
+}
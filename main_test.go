@@ -0,0 +1,2284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/NicoNex/echotron/v3"
+	"github.com/joomcode/errorx"
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeTelegramApi records what the bot sends instead of calling Telegram
+type fakeTelegramApi struct {
+	mu        sync.Mutex
+	messages  []fakeMessage
+	edits     []string
+	reactions []string
+	documents int
+	// reactionErr fails setting reactions, e.g. like a chat with reactions disabled would
+	reactionErr error
+}
+
+type fakeMessage struct {
+	text    string
+	chatId  int64
+	options *echotron.MessageOptions
+}
+
+func (f *fakeTelegramApi) SendMessage(
+	text string,
+	chatID int64,
+	opts *echotron.MessageOptions,
+) (echotron.APIResponseMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, fakeMessage{text, chatID, opts})
+	return echotron.APIResponseMessage{Result: &echotron.Message{ID: len(f.messages)}}, nil
+}
+
+func (f *fakeTelegramApi) EditMessageText(
+	text string,
+	_ echotron.MessageIDOptions,
+	_ *echotron.MessageTextOptions,
+) (echotron.APIResponseMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.edits = append(f.edits, text)
+	return echotron.APIResponseMessage{}, nil
+}
+
+func (f *fakeTelegramApi) SendDocument(
+	_ echotron.InputFile,
+	_ int64,
+	_ *echotron.DocumentOptions,
+) (echotron.APIResponseMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.documents++
+	return echotron.APIResponseMessage{}, nil
+}
+
+func (f *fakeTelegramApi) SetMessageReaction(
+	_ int64,
+	_ int,
+	opts *echotron.MessageReactionOptions,
+) (echotron.APIResponseBool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reactionErr != nil {
+		return echotron.APIResponseBool{}, f.reactionErr
+	}
+	f.reactions = append(f.reactions, opts.Reaction[0].Emoji)
+	return echotron.APIResponseBool{Result: true}, nil
+}
+
+// texts returns the texts of the sent messages in order
+func (f *fakeTelegramApi) texts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	texts := make([]string, 0, len(f.messages))
+	for _, message := range f.messages {
+		texts = append(texts, message.text)
+	}
+	return texts
+}
+
+// fakeRepository keeps bookmarks in memory like linkding would
+type fakeRepository struct {
+	mu        sync.Mutex
+	bookmarks []*Bookmark
+	created   []*CreateBookmarkPayload
+	updated   []*UpdateBookmarkPayload
+	// queries are the search queries bookmarks were listed with, only "#tag" ones filter
+	queries []string
+	// createErr fails creating bookmarks when set
+	createErr error
+}
+
+func (f *fakeRepository) CreateBookmark(_ context.Context, payload *CreateBookmarkPayload) (*Bookmark, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	for _, bookmark := range f.bookmarks {
+		if bookmark.URL == payload.URL {
+			return nil, BookmarkExists.New("bookmark for %s already exists", payload.URL)
+		}
+	}
+	f.created = append(f.created, payload)
+	bookmark := &Bookmark{
+		ID:          len(f.created),
+		URL:         payload.URL,
+		Title:       payload.Title,
+		Description: payload.Description,
+		Notes:       payload.Notes,
+		IsArchived:  payload.IsArchived,
+		Unread:      payload.Unread,
+		Shared:      payload.Shared,
+		TagNames:    payload.TagNames,
+	}
+	f.bookmarks = append(f.bookmarks, bookmark)
+	return bookmark, nil
+}
+
+func (f *fakeRepository) CheckBookmark(_ context.Context, url string) (*Bookmark, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, bookmark := range f.bookmarks {
+		if bookmark.URL == url {
+			return bookmark, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeRepository) UpdateBookmark(_ context.Context, id int, payload *UpdateBookmarkPayload) (*Bookmark, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updated = append(f.updated, payload)
+	for _, bookmark := range f.bookmarks {
+		if bookmark.ID != id {
+			continue
+		}
+		if payload.Title != nil {
+			bookmark.Title = *payload.Title
+		}
+		if payload.Description != nil {
+			bookmark.Description = *payload.Description
+		}
+		if payload.IsArchived != nil {
+			bookmark.IsArchived = *payload.IsArchived
+		}
+		if payload.Unread != nil {
+			bookmark.Unread = *payload.Unread
+		}
+		return bookmark, nil
+	}
+	return nil, LinkdingRejected.New("no bookmark %d", id)
+}
+
+func (f *fakeRepository) DeleteBookmark(_ context.Context, id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, bookmark := range f.bookmarks {
+		if bookmark.ID == id {
+			f.bookmarks = append(f.bookmarks[:i], f.bookmarks[i+1:]...)
+			return nil
+		}
+	}
+	return LinkdingRejected.New("no bookmark %d", id)
+}
+
+func (f *fakeRepository) GetBookmarks(
+	_ context.Context,
+	archived bool,
+	query string,
+	offset, limit int,
+) (*BookmarkPage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, query)
+	tag, byTag := strings.CutPrefix(query, "#")
+	matching := make([]*Bookmark, 0)
+	for _, bookmark := range f.bookmarks {
+		if bookmark.IsArchived == archived && (!byTag || slices.Contains(bookmark.TagNames, tag)) {
+			matching = append(matching, bookmark)
+		}
+	}
+	page := &BookmarkPage{Count: len(matching), Results: make([]*Bookmark, 0)}
+	if offset < len(matching) {
+		page.Results = matching[offset:min(offset+limit, len(matching))]
+	}
+	if offset+limit < len(matching) {
+		page.Next = "next"
+	}
+	return page, nil
+}
+
+func (f *fakeRepository) SetApiToken(string) {}
+
+// urls returns the URLs of the stored bookmarks
+func (f *fakeRepository) urls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	urls := make([]string, 0, len(f.bookmarks))
+	for _, bookmark := range f.bookmarks {
+		urls = append(urls, bookmark.URL)
+	}
+	return urls
+}
+
+// fakePageInfoService answers with the configured page info, or a title made from the URL for other pages
+type fakePageInfoService struct {
+	mu      sync.Mutex
+	pages   map[string]*PageInfo
+	fetches []string
+	// err fails every fetch when set
+	err error
+}
+
+func (f *fakePageInfoService) GetPageInfo(_ context.Context, url string) (*PageInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetches = append(f.fetches, url)
+	if f.err != nil {
+		return nil, f.err
+	}
+	if page, ok := f.pages[url]; ok {
+		return page, nil
+	}
+	return &PageInfo{url: url, title: "Title of " + url}, nil
+}
+
+const testChatId = 42
+
+var (
+	alice   = &echotron.User{ID: 1, Username: "alice"}
+	bob     = &echotron.User{ID: 2, Username: "bob"}
+	mallory = &echotron.User{ID: 3, Username: "mallory"}
+)
+
+// testBot wires a bot for the test chat to a fake Telegram API and a link service over a fake repository,
+// alice and bob are allowed
+type testBot struct {
+	echotron.Bot
+	api         *fakeTelegramApi
+	repository  *fakeRepository
+	pageInfo    *fakePageInfoService
+	linkService LinkService
+}
+
+func newTestBot(t *testing.T, options BotOptions, linkOptions LinkServiceOptions) *testBot {
+	t.Helper()
+	return newTestBotWithTags(t, options, linkOptions, GetTagsWithExtractors())
+}
+
+// newTestBotWithTags is newTestBot with the tag extractor main would build from the config
+func newTestBotWithTags(
+	t *testing.T,
+	options BotOptions,
+	linkOptions LinkServiceOptions,
+	tagExtractor TagExtractor,
+) *testBot {
+	t.Helper()
+	users, err := ParseUserSet([]string{"alice", "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.AllowedSchemes == nil {
+		options.AllowedSchemes = []string{"http", "https"}
+	}
+	if options.TimeWindowsLocation == nil {
+		options.TimeWindowsLocation = time.UTC
+	}
+	tb := &testBot{
+		api:        &fakeTelegramApi{},
+		repository: &fakeRepository{},
+		pageInfo:   &fakePageInfoService{},
+	}
+	tb.linkService = NewLinkdingLinkService(tb.repository, tb.pageInfo, linkOptions)
+	factory := NewBotFactory(
+		"token",
+		NewAllowlist(users),
+		NewUrlExtractors(true),
+		tagExtractor,
+		tb.linkService,
+		nopAuditLog{},
+		options,
+		tb.api,
+	)
+	tb.Bot = factory.NewBot()(testChatId)
+	return tb
+}
+
+// send handles a message from the user in the test chat
+func (tb *testBot) send(user *echotron.User, msg *echotron.Message) {
+	msg.From = user
+	msg.Chat = echotron.Chat{ID: testChatId, Type: "private"}
+	tb.Update(&echotron.Update{Message: msg})
+}
+
+// textMessage makes a message with url entities for the URLs in the text
+func textMessage(text string) *echotron.Message {
+	return &echotron.Message{Text: text, Entities: textEntities(text)}
+}
+
+// wordPattern splits text into words and the whitespace between them
+var wordPattern = regexp.MustCompile(`\s+|\S+`)
+
+// textEntities marks every whitespace separated word with a scheme as a url entity and every word starting with #
+// as a hashtag entity, like Telegram would
+func textEntities(text string) []*echotron.MessageEntity {
+	entities := make([]*echotron.MessageEntity, 0)
+	offset := 0
+	for _, word := range wordPattern.FindAllString(text, -1) {
+		switch {
+		case strings.Contains(word, "://"):
+			entities = append(entities, &echotron.MessageEntity{Type: "url", Offset: offset, Length: utf16Length(word)})
+		case len(word) > 1 && strings.HasPrefix(word, "#"):
+			entities = append(entities, &echotron.MessageEntity{Type: "hashtag", Offset: offset, Length: utf16Length(word)})
+		}
+		offset += utf16Length(word)
+	}
+	return entities
+}
+
+func TestBusinessMessagesOnlyAnswerSaves(t *testing.T) {
+	tb := newTestBot(t, BotOptions{ReplyOnNoUrls: true}, LinkServiceOptions{})
+	business := func(user *echotron.User, text string) {
+		msg := textMessage(text)
+		msg.From, msg.BusinessConnectionID = user, "connection"
+		msg.Chat = echotron.Chat{ID: testChatId, Type: "private"}
+		tb.Update(&echotron.Update{BusinessMessage: msg})
+	}
+
+	business(mallory, "https://example.com/mallory")
+	business(mallory, "/whoami")
+	business(alice, "no links here")
+	business(alice, "/unknown")
+	business(alice, "ftp://example.com/file")
+	if texts := tb.api.texts(); len(texts) != 0 {
+		t.Fatalf("expected no replies, got %q", texts)
+	}
+	if urls := tb.repository.urls(); len(urls) != 0 {
+		t.Fatalf("expected nothing saved, got %v", urls)
+	}
+
+	business(alice, "https://example.com/alice")
+	if urls := tb.repository.urls(); len(urls) != 1 || urls[0] != "https://example.com/alice" {
+		t.Fatalf("expected the link to be saved, got %v", urls)
+	}
+	if len(tb.api.messages) != 1 || tb.api.messages[0].options.BusinessConnectionID != "connection" {
+		t.Fatalf("expected a reply through the business connection, got %+v", tb.api.messages)
+	}
+}
+
+func TestChunkMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		maxLength int
+		expected  []string
+	}{
+		{"short", "Saved!", 10, []string{"Saved!"}},
+		{"empty", "", 10, []string{}},
+		{"split between lines", "aaa\nbbb\nccc", 8, []string{"aaa\nbbb\n", "ccc"}},
+		{"long line split between runes", "abcdefgh", 3, []string{"abc", "def", "gh"}},
+		{"surrogate pair kept whole", "ab😀cd", 3, []string{"ab", "😀c", "d"}},
+		{"long line after short one", "a\nbcdef", 3, []string{"a\n", "bcd", "ef"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := chunkMessage(test.text, test.maxLength)
+			if !slices.Equal(chunks, test.expected) {
+				t.Fatalf("expected %q, got %q", test.expected, chunks)
+			}
+			for _, chunk := range chunks {
+				if utf16Length(chunk) > test.maxLength {
+					t.Errorf("chunk %q is longer than %d", chunk, test.maxLength)
+				}
+			}
+			if joined := strings.Join(chunks, ""); joined != test.text {
+				t.Errorf("chunks don't add up to the text: %q", joined)
+			}
+		})
+	}
+}
+
+func TestFinishPendingMessageChunksLongResults(t *testing.T) {
+	tb := newTestBot(t, BotOptions{OptimisticReply: true}, LinkServiceOptions{})
+	line := strings.Repeat("x", 99) + "\n"
+	text := strings.Repeat(line, TelegramMessageMaxLength/len(line)+1)
+
+	tb.Bot.(*bot).finishPendingMessage(&echotron.Message{ID: 1}, text)
+
+	if len(tb.api.edits) != 1 || len(tb.api.messages) != 1 {
+		t.Fatalf("expected the pending message edited and one more message, got %d edits and %d messages",
+			len(tb.api.edits), len(tb.api.messages))
+	}
+	if tb.api.edits[0]+tb.api.messages[0].text != text {
+		t.Fatal("expected the edit and the message to add up to the result")
+	}
+}
+
+func TestNotePlaceholderUrl(t *testing.T) {
+	tests := []struct {
+		chat     echotron.Chat
+		expected string
+	}{
+		{echotron.Chat{ID: -1001234567890, Type: "supergroup"}, "https://t.me/c/1234567890/7"},
+		{echotron.Chat{ID: -1001234567890, Type: "channel", Username: "news"}, "https://t.me/news/7"},
+		{echotron.Chat{ID: 42, Type: "private"}, "https://t.me/#note/42/7"},
+		{echotron.Chat{ID: -4242, Type: "group"}, "https://t.me/#note/-4242/7"},
+	}
+	for _, test := range tests {
+		if url := notePlaceholderUrl(&echotron.Message{ID: 7, Chat: test.chat}); url != test.expected {
+			t.Errorf("expected %s for a %s chat, got %s", test.expected, test.chat.Type, url)
+		}
+	}
+}
+
+// sliceUtf16Reference is a plain reimplementation of sliceUtf16: it keeps every rune whose UTF-16 code units
+// overlap the range, which widens offsets in the middle of a surrogate pair to the whole pair
+func sliceUtf16Reference(s string, start, end int) (string, bool) {
+	if start < 0 || end < start || end > utf16Length(s) {
+		return "", false
+	}
+	var substr strings.Builder
+	position := 0
+	for _, r := range s {
+		length := utf16RuneLength(r)
+		if position < end && position+length > start {
+			substr.WriteRune(r)
+		}
+		position += length
+	}
+	return substr.String(), true
+}
+
+func FuzzSliceUtf16(f *testing.F) {
+	f.Add("https://example.com", 0, 19)
+	f.Add("see 😀 https://example.com", 7, 26)
+	f.Add("😀😀", 1, 3)
+	f.Add("😀", 1, 1)
+	f.Add("", 0, 0)
+	f.Add("abc", 2, 1)
+	f.Fuzz(func(t *testing.T, s string, start, end int) {
+		substr, ok := sliceUtf16(s, start, end)
+		expected, expectedOk := sliceUtf16Reference(s, start, end)
+		if substr != expected || ok != expectedOk {
+			t.Fatalf("sliceUtf16(%q, %d, %d) = %q, %v, expected %q, %v", s, start, end, substr, ok, expected, expectedOk)
+		}
+	})
+}
+
+func FuzzSliceUtf16Entity(f *testing.F) {
+	f.Add("see ", "https://example.com", " now")
+	f.Add("😀 ", "https://example.com/😀", "😀")
+	f.Fuzz(func(t *testing.T, prefix, entity, suffix string) {
+		if !utf8.ValidString(prefix) || !utf8.ValidString(entity) || !utf8.ValidString(suffix) {
+			t.Skip("Telegram texts are valid UTF-8")
+		}
+		text := prefix + entity + suffix
+		offset := utf16Length(prefix)
+		substr, ok := sliceUtf16(text, offset, offset+utf16Length(entity))
+		if !ok || substr != entity {
+			t.Fatalf("expected the entity %q, got %q, %v", entity, substr, ok)
+		}
+	})
+}
+
+// newLinkdingServer fakes the linkding bookmarks API, recording the created bookmarks. Requests without the token
+// get a 401 like from linkding
+func newLinkdingServer(t *testing.T, token string) (*httptest.Server, *[]CreateBookmarkPayload) {
+	t.Helper()
+	var mu sync.Mutex
+	created := make([]CreateBookmarkPayload, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/bookmarks/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"detail":"Invalid token."}`))
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var payload CreateBookmarkPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		created = append(created, payload)
+		id := len(created)
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(Bookmark{ID: id, URL: payload.URL, Title: payload.Title, TagNames: payload.TagNames})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &created
+}
+
+// newPageServer serves the HTML at /page, every other path fails with a 500
+func newPageServer(t *testing.T, page string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/page" {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(page))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newHttpLinkService wires the real repository, page info and link services to the servers
+func newHttpLinkService(linkdingUrl, token string) LinkService {
+	repository := NewLinkdingRepository(linkdingUrl, token, NewHttpClient(TransportOptions{}), LinkdingRepositoryOptions{})
+	pageInfoService := NewPageInfoService(NewHttpClient(TransportOptions{}), PageInfoServiceOptions{})
+	return NewLinkdingLinkService(repository, pageInfoService, LinkServiceOptions{})
+}
+
+func TestSaveAgainstHttpServers(t *testing.T) {
+	linkding, created := newLinkdingServer(t, "secret")
+	pages := newPageServer(t, `<html><head><title>Hello</title><meta name="description" content="A page"></head></html>`)
+
+	t.Run("happy path", func(t *testing.T) {
+		linkService := newHttpLinkService(linkding.URL, "secret")
+		bookmark, err := linkService.Save(context.Background(), pages.URL+"/page", &SaveOptions{TagNames: []string{"go"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if bookmark.ID != 1 || len(*created) != 1 {
+			t.Fatalf("expected one bookmark, got %+v and %+v", bookmark, *created)
+		}
+		payload := (*created)[0]
+		if payload.URL != pages.URL+"/page" || payload.Title != "Hello" || payload.Description != "A page" ||
+			!payload.Unread || !slices.Equal(payload.TagNames, []string{"go"}) {
+			t.Fatalf("unexpected payload %+v", payload)
+		}
+	})
+
+	t.Run("linkding rejects the token", func(t *testing.T) {
+		linkService := newHttpLinkService(linkding.URL, "wrong")
+		_, err := linkService.Save(context.Background(), pages.URL+"/page", nil)
+		if !errorx.IsOfType(err, LinkdingRejected) || errorx.HasTrait(err, errorx.Temporary()) {
+			t.Fatalf("expected a permanent rejection, got %+v", err)
+		}
+		if status, _ := errorx.ExtractProperty(err, PropertyStatus); status != http.StatusUnauthorized {
+			t.Fatalf("expected status 401, got %v", status)
+		}
+	})
+
+	t.Run("page fails", func(t *testing.T) {
+		before := len(*created)
+		linkService := newHttpLinkService(linkding.URL, "secret")
+		_, err := linkService.Save(context.Background(), pages.URL+"/broken", nil)
+		if err == nil || !strings.Contains(err.Error(), "status 500") {
+			t.Fatalf("expected the page status in the error, got %+v", err)
+		}
+		if len(*created) != before {
+			t.Fatal("expected no bookmark for a failed page")
+		}
+	})
+}
+
+func FuzzExtraction(f *testing.F) {
+	f.Add("see https://example.com now", 4, 19, "")
+	f.Add("😀 https://example.com/😀", 3, 22, "")
+	f.Add("link", 0, 4, "https://example.com/hidden")
+	f.Add("short", 3, 100, "")
+	f.Add("negative", -1, 3, "")
+	f.Fuzz(func(t *testing.T, text string, offset, length int, textLinkUrl string) {
+		entityType := echotron.MessageEntityType("url")
+		if textLinkUrl != "" {
+			entityType = "text_link"
+		}
+		msg := &echotron.Message{
+			Text:     text,
+			Entities: []*echotron.MessageEntity{{Type: entityType, Offset: offset, Length: length, URL: textLinkUrl}},
+		}
+		urls := GetUrlsFromEntities(msg)
+		if len(urls) > 1 {
+			t.Fatalf("expected at most one URL for one entity, got %q", urls)
+		}
+		for _, u := range urls {
+			if textLinkUrl != "" && u != textLinkUrl {
+				t.Fatalf("expected the text link URL %q, got %q", textLinkUrl, u)
+			}
+			if textLinkUrl == "" && utf8.ValidString(text) && !strings.Contains(text, u) {
+				t.Fatalf("expected a substring of %q, got %q", text, u)
+			}
+		}
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	t.Run("allowed user saves a link", func(t *testing.T) {
+		tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+		tb.send(alice, textMessage("look https://example.com/post"))
+		if urls := tb.repository.urls(); !slices.Equal(urls, []string{"https://example.com/post"}) {
+			t.Fatalf("expected the link saved, got %v", urls)
+		}
+		if texts := tb.api.texts(); !slices.Equal(texts, []string{"Saved!"}) {
+			t.Fatalf("expected a saved reply, got %q", texts)
+		}
+	})
+
+	t.Run("unauthorized user is turned away", func(t *testing.T) {
+		tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+		tb.send(mallory, textMessage("https://example.com/post"))
+		if urls := tb.repository.urls(); len(urls) != 0 {
+			t.Fatalf("expected nothing saved, got %v", urls)
+		}
+		if texts := tb.api.texts(); !slices.Equal(texts, []string{"You are not allowed to use this bot"}) {
+			t.Fatalf("expected a rejection, got %q", texts)
+		}
+	})
+
+	t.Run("message without URLs", func(t *testing.T) {
+		tb := newTestBot(t, BotOptions{ReplyOnNoUrls: true}, LinkServiceOptions{})
+		tb.send(alice, textMessage("just text"))
+		if texts := tb.api.texts(); !slices.Equal(texts, []string{"No URLs found in the message"}) {
+			t.Fatalf("expected the no URLs reply, got %q", texts)
+		}
+		if len(tb.pageInfo.fetches) != 0 || len(tb.repository.urls()) != 0 {
+			t.Fatal("expected nothing fetched or saved")
+		}
+	})
+}
+
+// TestConcurrentSavesAndUndos is meant for go test -race, updates of a chat are handled concurrently
+func TestConcurrentSavesAndUndos(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+	var wg sync.WaitGroup
+	for _, user := range []*echotron.User{alice, bob} {
+		wg.Add(1)
+		go func(user *echotron.User) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				tb.send(user, textMessage(fmt.Sprintf("https://example.com/%s/%d", user.Username, i)))
+				tb.send(user, &echotron.Message{Text: "/undo"})
+			}
+		}(user)
+	}
+	wg.Wait()
+	if urls := tb.repository.urls(); len(urls) != 0 {
+		t.Fatalf("expected every save undone, got %v", urls)
+	}
+}
+
+func TestExtractUrlsFromUpdateJSON(t *testing.T) {
+	tests := []struct {
+		fixture         string
+		saveCaptionUrls bool
+		expected        []string
+	}{
+		{"text_links.json", true, []string{"https://example.com/a", "https://example.org/hidden"}},
+		{"photo_caption.json", true, []string{"https://example.com/photo"}},
+		{"photo_caption.json", false, []string{}},
+		{"blocked_schemes.json", true, []string{"https://example.com/page"}},
+		{"link_preview.json", true, []string{"https://example.com/preview", "https://example.com/text"}},
+		{"no_message.json", true, []string{}},
+		{"via_bot.json", true, []string{"https://example.com/shared", "https://example.org/source"}},
+		{"keyboard_without_via_bot.json", true, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s with caption URLs %v", test.fixture, test.saveCaptionUrls), func(t *testing.T) {
+			update, err := os.ReadFile(filepath.Join("testdata", "updates", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			options := BotOptions{AllowedSchemes: DefaultAllowedSchemes}
+			urls, err := ExtractUrlsFromUpdateJSON(update, NewUrlExtractors(test.saveCaptionUrls), options)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if !slices.Equal(urls, test.expected) {
+				t.Fatalf("expected %q, got %q", test.expected, urls)
+			}
+		})
+	}
+}
+
+func TestBatchReplyMentionsSkippedLinks(t *testing.T) {
+	tb := newTestBot(t, BotOptions{BatchWindow: time.Hour, MaxUrlsPerMessage: 1}, LinkServiceOptions{})
+	tb.send(alice, textMessage("https://example.com/a https://example.com/b"))
+	tb.send(alice, textMessage("https://example.com/c https://example.com/d https://example.com/e"))
+	if texts := tb.api.texts(); len(texts) != 0 {
+		t.Fatalf("expected no reply before the batch window ends, got %q", texts)
+	}
+
+	tb.Bot.(*bot).flushBatch()
+	if urls := tb.repository.urls(); !slices.Equal(urls, []string{"https://example.com/a", "https://example.com/c"}) {
+		t.Fatalf("expected the first link of each message saved, got %v", urls)
+	}
+	texts := tb.api.texts()
+	if len(texts) != 1 || !strings.Contains(texts[0], "Skipped 3 more links, at most 1 are saved per message") {
+		t.Fatalf("expected the batch reply to mention the skipped links, got %q", texts)
+	}
+}
+
+func TestReviewOverridesDomainRules(t *testing.T) {
+	linkOptions := LinkServiceOptions{
+		AutoArchiveDomains: []string{"archive.example.com"},
+		ReadDomains:        []string{"read.example.com"},
+	}
+	tb := newTestBot(t, BotOptions{ReviewTag: "review"}, linkOptions)
+	tb.send(alice, textMessage("/review https://archive.example.com/a"))
+	tb.send(alice, textMessage("/review https://read.example.com/b"))
+	tb.send(alice, textMessage("https://read.example.com/c"))
+
+	created := tb.repository.created
+	if len(created) != 3 {
+		t.Fatalf("expected 3 bookmarks, got %d", len(created))
+	}
+	for _, payload := range created[:2] {
+		if payload.IsArchived || !payload.Unread {
+			t.Errorf("expected %s saved unread for review, got archived=%v unread=%v",
+				payload.URL, payload.IsArchived, payload.Unread)
+		}
+	}
+	if created[2].Unread {
+		t.Errorf("expected %s from a read domain saved as read outside /review", created[2].URL)
+	}
+}
+
+func TestStaleBookmarks(t *testing.T) {
+	cutoff := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	old, recent := cutoff.Add(-time.Hour), cutoff.Add(time.Hour)
+	bookmarks := []*Bookmark{
+		{ID: 1, Unread: true, DateAdded: old, TagNames: []string{"telegram"}},
+		{ID: 2, Unread: true, DateAdded: recent, TagNames: []string{"telegram"}},
+		{ID: 3, Unread: false, DateAdded: old, TagNames: []string{"telegram"}},
+		{ID: 4, Unread: true, IsArchived: true, DateAdded: old, TagNames: []string{"telegram"}},
+		{ID: 5, Unread: true, DateAdded: old, TagNames: []string{"other"}},
+		{ID: 6, Unread: true, DateAdded: cutoff, TagNames: []string{"telegram"}},
+	}
+	ids := make([]int, 0)
+	for _, bookmark := range staleBookmarks(bookmarks, "telegram", cutoff) {
+		ids = append(ids, bookmark.ID)
+	}
+	if !slices.Equal(ids, []int{1}) {
+		t.Fatalf("expected only the old unread tagged bookmark, got %v", ids)
+	}
+}
+
+func TestArchiveStaleSearchesByTag(t *testing.T) {
+	cutoff := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	repository := &fakeRepository{bookmarks: []*Bookmark{
+		{ID: 1, URL: "https://example.com/a", Unread: true, DateAdded: cutoff.Add(-time.Hour), TagNames: []string{"telegram"}},
+		{ID: 2, URL: "https://example.com/b", Unread: true, DateAdded: cutoff.Add(-time.Hour)},
+	}}
+	service := NewLinkdingLinkService(repository, &fakePageInfoService{}, LinkServiceOptions{})
+	archived, err := service.ArchiveStale(context.Background(), "telegram", cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archived != 1 || !repository.bookmarks[0].IsArchived || repository.bookmarks[1].IsArchived {
+		t.Fatalf("expected only the tagged bookmark archived, archived %d", archived)
+	}
+	if !slices.Equal(repository.queries, []string{"#telegram"}) {
+		t.Fatalf("expected bookmarks listed by tag, got queries %q", repository.queries)
+	}
+}
+
+func TestAllowedChatTypes(t *testing.T) {
+	tb := newTestBot(t, BotOptions{AllowedChatTypes: []string{"private"}, SilentChatTypeRejection: true}, LinkServiceOptions{})
+	msg := textMessage("https://example.com/group")
+	msg.From = alice
+	msg.Chat = echotron.Chat{ID: testChatId, Type: "group"}
+	tb.Update(&echotron.Update{Message: msg})
+	if urls := tb.repository.urls(); len(urls) != 0 {
+		t.Fatalf("expected the group message ignored, got %v saved", urls)
+	}
+	if texts := tb.api.texts(); len(texts) != 0 {
+		t.Fatalf("expected no reply to the group message, got %q", texts)
+	}
+
+	tb.send(alice, textMessage("https://example.com/private"))
+	if urls := tb.repository.urls(); !slices.Equal(urls, []string{"https://example.com/private"}) {
+		t.Fatalf("expected the private message saved, got %v", urls)
+	}
+}
+
+func TestAllowedSchemes(t *testing.T) {
+	t.Run("default allows https and denies other schemes", func(t *testing.T) {
+		tb := newTestBot(t, BotOptions{AllowedSchemes: DefaultAllowedSchemes}, LinkServiceOptions{})
+		tb.send(alice, textMessage("ftp://example.com/file"))
+		if urls := tb.repository.urls(); len(urls) != 0 {
+			t.Fatalf("expected the ftp link skipped, got %v", urls)
+		}
+		texts := tb.api.texts()
+		if !slices.Equal(texts, []string{"No savable URLs in the message (all blocked or invalid)"}) {
+			t.Fatalf("expected the no savable URLs reply, got %q", texts)
+		}
+
+		tb.send(alice, textMessage("https://example.com/page"))
+		if urls := tb.repository.urls(); !slices.Equal(urls, []string{"https://example.com/page"}) {
+			t.Fatalf("expected the https link saved, got %v", urls)
+		}
+		if !slices.Equal(tb.pageInfo.fetches, []string{"https://example.com/page"}) {
+			t.Fatalf("expected the https page fetched, got %v", tb.pageInfo.fetches)
+		}
+	})
+
+	t.Run("allowed non-http scheme is saved without a fetch", func(t *testing.T) {
+		tb := newTestBot(t, BotOptions{AllowedSchemes: []string{"http", "https", "ftp"}}, LinkServiceOptions{})
+		tb.send(alice, textMessage("ftp://example.com/file"))
+		if urls := tb.repository.urls(); !slices.Equal(urls, []string{"ftp://example.com/file"}) {
+			t.Fatalf("expected the ftp link saved, got %v", urls)
+		}
+		if len(tb.pageInfo.fetches) != 0 {
+			t.Fatalf("expected no page fetch, got %v", tb.pageInfo.fetches)
+		}
+	})
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text, command, args string
+		ok                  bool
+	}{
+		{"/save https://example.com", "save", "https://example.com", true},
+		{"/save@mybot https://example.com", "save", "https://example.com", true},
+		{"/save@MyBot", "save", "", true},
+		{"/save@otherbot https://example.com", "", "", true},
+		{"/delete\nhttps://example.com", "delete", "https://example.com", true},
+		{"/Undo", "undo", "", true},
+		{"https://example.com", "", "", false},
+		{"/", "", "", false},
+	}
+	for _, test := range tests {
+		command, args, ok := parseCommand(test.text, "mybot")
+		if command != test.command || args != test.args || ok != test.ok {
+			t.Errorf("parseCommand(%q) = %q, %q, %v, expected %q, %q, %v",
+				test.text, command, args, ok, test.command, test.args, test.ok)
+		}
+	}
+}
+
+func TestErrorLogLimiterPrunesExpiredEntries(t *testing.T) {
+	limiter := newErrorLogLimiter(20 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if allowed, _ := limiter.Allow(fmt.Sprintf("PATCH /api/bookmarks/%d/ 500", i)); !allowed {
+			t.Fatalf("expected the first error of key %d logged", i)
+		}
+	}
+	if allowed, _ := limiter.Allow("PATCH /api/bookmarks/0/ 500"); allowed {
+		t.Fatal("expected a repeated error within the window suppressed")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if allowed, _ := limiter.Allow("GET /api/bookmarks/ 500"); !allowed {
+		t.Fatal("expected a new error logged")
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if len(limiter.entries) != 1 {
+		t.Fatalf("expected the expired entries pruned, %d left", len(limiter.entries))
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	handled := 0
+	handler := NewWebhookHandler("s3cret", func(w http.ResponseWriter, r *http.Request) {
+		handled++
+	})
+	tests := []struct {
+		name    string
+		secret  string
+		status  int
+		handled int
+	}{
+		{"correct secret", "s3cret", http.StatusOK, 1},
+		{"incorrect secret", "wrong", http.StatusForbidden, 0},
+		{"missing secret", "", http.StatusForbidden, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handled = 0
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("{}"))
+			if test.secret != "" {
+				req.Header.Set(TelegramSecretTokenHeader, test.secret)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, rec.Code)
+			}
+			if handled != test.handled {
+				t.Fatalf("expected the update handled %d times, got %d", test.handled, handled)
+			}
+		})
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to log to from several goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+// captureLogs collects the output of the standard logger at the level until the test ends
+func captureLogs(t *testing.T, level log.Level) *syncBuffer {
+	t.Helper()
+	logger := log.StandardLogger()
+	out, previousLevel := logger.Out, logger.GetLevel()
+	buf := &syncBuffer{}
+	logger.SetOutput(buf)
+	logger.SetLevel(level)
+	t.Cleanup(func() {
+		logger.SetOutput(out)
+		logger.SetLevel(previousLevel)
+	})
+	return buf
+}
+
+func TestTraceLoggingRedactsCredentials(t *testing.T) {
+	logs := captureLogs(t, log.TraceLevel)
+	server, _ := newLinkdingServer(t, "secret-token")
+	options := LinkdingRepositoryOptions{ExtraHeaders: http.Header{"X-Proxy-Auth": {"proxy-secret"}}}
+	repository := NewLinkdingRepository(server.URL, "secret-token", NewHttpClient(TransportOptions{}), options)
+	if _, err := repository.CreateBookmark(context.Background(), &CreateBookmarkPayload{URL: "https://example.com"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, "Linkding request") || !strings.Contains(output, "Linkding response") {
+		t.Fatalf("expected the request and response traced, got %s", output)
+	}
+	for _, secret := range []string{"secret-token", "proxy-secret"} {
+		if strings.Contains(output, secret) {
+			t.Errorf("expected %s redacted, got %s", secret, output)
+		}
+	}
+	if !strings.Contains(output, "REDACTED") {
+		t.Errorf("expected the redacted headers logged, got %s", output)
+	}
+}
+
+func TestTrimUrlWrapping(t *testing.T) {
+	tests := []struct {
+		raw, expected string
+	}{
+		{"https://example.com", "https://example.com"},
+		{"(https://example.com)", "https://example.com"},
+		{"<https://example.com>", "https://example.com"},
+		{"[https://example.com].", "https://example.com"},
+		{`"https://example.com",`, "https://example.com"},
+		{"'https://example.com/page'?!", "https://example.com/page"},
+		{"https://example.com/page...", "https://example.com/page"},
+		{"https://en.wikipedia.org/wiki/Go_(game)", "https://en.wikipedia.org/wiki/Go_(game)"},
+		{"(https://en.wikipedia.org/wiki/Go_(game))", "https://en.wikipedia.org/wiki/Go_(game)"},
+		{"https://en.wikipedia.org/wiki/Go_(game)).", "https://en.wikipedia.org/wiki/Go_(game)"},
+		{"https://example.com/search?q={x}", "https://example.com/search?q={x}"},
+		{"  https://example.com/ ", "https://example.com/"},
+		{"(\"'.", ""},
+	}
+	for _, test := range tests {
+		if trimmed := trimUrlWrapping(test.raw); trimmed != test.expected {
+			t.Errorf("trimUrlWrapping(%q) = %q, expected %q", test.raw, trimmed, test.expected)
+		}
+	}
+}
+
+func TestIsValidUrl(t *testing.T) {
+	tests := []struct {
+		raw   string
+		valid bool
+	}{
+		{"https://example.com/page", true},
+		{"HTTP://example.com", true},
+		{"example.com/page", true},
+		{"example.com:8080/page", true},
+		{"mailto:alice@example.com", false},
+		{"tel:+123456789", false},
+		{"javascript:alert(1)", false},
+		{"ftp://example.com/file", false},
+		{"https://", false},
+		{"http://[::1", false},
+		{"https://exa mple.com/%zz", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if valid := isValidUrl(test.raw, DefaultAllowedSchemes); valid != test.valid {
+			t.Errorf("isValidUrl(%q) = %v, expected %v", test.raw, valid, test.valid)
+		}
+	}
+}
+
+func TestGetTagsFromMentions(t *testing.T) {
+	msg := &echotron.Message{
+		Text: "thanks @carol and Dave and Erin",
+		Entities: []*echotron.MessageEntity{
+			{Type: "mention", Offset: 7, Length: 6},
+			{Type: "text_mention", Offset: 18, Length: 4, User: &echotron.User{ID: 4, Username: "dave_d"}},
+			{Type: "text_mention", Offset: 27, Length: 4, User: &echotron.User{ID: 5}},
+		},
+	}
+	if tags := GetTagsFromMentions(msg); !slices.Equal(tags, []string{"carol", "dave_d", "Erin"}) {
+		t.Fatalf("expected tags from the mention, the username and the name, got %q", tags)
+	}
+}
+
+func TestCachingPageInfoServiceHit(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<html><head><title>Cached page</title></head><body></body></html>"))
+	}))
+	t.Cleanup(server.Close)
+	service := NewCachingPageInfoService(
+		NewPageInfoService(NewHttpClient(TransportOptions{}), PageInfoServiceOptions{}), time.Hour)
+
+	for i := 0; i < 2; i++ {
+		info, err := service.GetPageInfo(context.Background(), server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if info.title != "Cached page" {
+			t.Fatalf("expected the page title, got %q", info.title)
+		}
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("expected the second fetch served from the cache, the page was requested %d times", hits.Load())
+	}
+
+	if _, err := service.GetPageInfo(withFreshPageInfo(context.Background()), server.URL); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("expected a fresh fetch to bypass the cache, the page was requested %d times", hits.Load())
+	}
+}
+
+func TestToggleCommands(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+	tb.send(alice, textMessage("https://example.com/a"))
+	tb.send(alice, textMessage("/toggle_archive https://example.com/a"))
+	tb.send(alice, textMessage("/toggle_read https://example.com/a"))
+	tb.send(alice, textMessage("/toggle_read https://example.com/missing"))
+
+	expected := []string{
+		"Saved!",
+		"Bookmark is now archived and unread",
+		"Bookmark is now archived and read",
+		"Not found",
+	}
+	if texts := tb.api.texts(); !slices.Equal(texts, expected) {
+		t.Fatalf("expected %q, got %q", expected, texts)
+	}
+	updated := tb.repository.updated
+	if len(updated) != 2 || updated[0].IsArchived == nil || !*updated[0].IsArchived ||
+		updated[1].Unread == nil || *updated[1].Unread || updated[1].IsArchived != nil {
+		t.Fatalf("expected the looked up bookmark patched once per toggle, got %+v", updated)
+	}
+}
+
+func TestGetPageInfoTranscodesCharset(t *testing.T) {
+	page, err := os.ReadFile(filepath.Join("testdata", "pages", "windows-1251.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=windows-1251")
+		_, _ = w.Write(page)
+	}))
+	t.Cleanup(server.Close)
+
+	service := NewPageInfoService(NewHttpClient(TransportOptions{}), PageInfoServiceOptions{})
+	info, err := service.GetPageInfo(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if info.title != "Привет" {
+		t.Fatalf("expected the title decoded from windows-1251, got %q", info.title)
+	}
+}
+
+func TestNewHttpClientTransport(t *testing.T) {
+	client := NewHttpClient(TransportOptions{
+		MaxIdleConns:          7,
+		MaxIdleConnsPerHost:   3,
+		IdleConnTimeout:       5 * time.Second,
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: 2 * time.Second,
+		Timeout:               9 * time.Second,
+	})
+	transport := client.Transport.(*http.Transport)
+	if transport.MaxIdleConns != 7 || transport.MaxIdleConnsPerHost != 3 || transport.IdleConnTimeout != 5*time.Second ||
+		!transport.DisableKeepAlives || transport.ResponseHeaderTimeout != 2*time.Second {
+		t.Fatalf("expected the transport configured from the options, got %+v", transport)
+	}
+	if client.Timeout != 9*time.Second {
+		t.Fatalf("expected a 9s client timeout, got %s", client.Timeout)
+	}
+
+	defaults := http.DefaultTransport.(*http.Transport)
+	transport = NewHttpClient(TransportOptions{}).Transport.(*http.Transport)
+	if transport.MaxIdleConns != defaults.MaxIdleConns || transport.IdleConnTimeout != defaults.IdleConnTimeout {
+		t.Fatalf("expected Go's defaults kept for unset options, got %+v", transport)
+	}
+}
+
+func TestOptimisticReply(t *testing.T) {
+	tb := newTestBot(t, BotOptions{OptimisticReply: true}, LinkServiceOptions{})
+	tb.send(alice, textMessage("https://example.com/a"))
+	if texts := tb.api.texts(); !slices.Equal(texts, []string{"Saving..."}) {
+		t.Fatalf("expected a pending reply, got %q", texts)
+	}
+	tb.api.mu.Lock()
+	defer tb.api.mu.Unlock()
+	if !slices.Equal(tb.api.edits, []string{"Saved!"}) {
+		t.Fatalf("expected the pending reply edited with the result, got %q", tb.api.edits)
+	}
+}
+
+func TestUrlTooLong(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{MaxUrlLength: 40})
+	long := "https://example.com/" + strings.Repeat("a", 40)
+	if _, err := tb.linkService.Save(context.Background(), long, &SaveOptions{}); !errorx.IsOfType(err, UrlTooLong) {
+		t.Fatalf("expected UrlTooLong, got %+v", err)
+	}
+
+	tb.send(alice, textMessage(long))
+	if texts := tb.api.texts(); !slices.Equal(texts, []string{"URL too long."}) {
+		t.Fatalf("expected the URL too long reply, got %q", texts)
+	}
+	if len(tb.pageInfo.fetches) != 0 || len(tb.repository.urls()) != 0 {
+		t.Fatal("expected the long URL neither fetched nor saved")
+	}
+}
+
+func TestDistinctUrls(t *testing.T) {
+	urls := []string{
+		"https://example.com",
+		"https://Example.COM/",
+		"http://example.com",
+		"https://example.com/page",
+		"https://EXAMPLE.com/page",
+		"https://example.com/page/",
+		"https://www.example.com/page",
+	}
+	expected := []string{
+		"https://example.com",
+		"https://example.com/page",
+		"https://example.com/page/",
+		"https://www.example.com/page",
+	}
+	if unique := distinctUrls(urls, UrlNormalization{}); !slices.Equal(unique, expected) {
+		t.Fatalf("expected %q, got %q", expected, unique)
+	}
+
+	expected = []string{"https://example.com", "https://example.com/page", "https://example.com/page/"}
+	if unique := distinctUrls(urls, UrlNormalization{StripWww: true}); !slices.Equal(unique, expected) {
+		t.Fatalf("expected www. ignored with StripWww, got %q", unique)
+	}
+}
+
+// fetchPageInfo serves the HTML and fetches its page info with a real page info service
+func fetchPageInfo(t *testing.T, page string, options PageInfoServiceOptions) *PageInfo {
+	t.Helper()
+	server := newPageServer(t, page)
+	service := NewPageInfoService(NewHttpClient(TransportOptions{}), options)
+	info, err := service.GetPageInfo(context.Background(), server.URL+"/page")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	return info
+}
+
+func TestPreviewImage(t *testing.T) {
+	withImage := `<html><head><title>Photo</title>
+<meta property="og:image" content="https://cdn.example.com/photo.jpg"></head><body></body></html>`
+	withoutImage := `<html><head><title>Text</title></head><body></body></html>`
+
+	options := PageInfoServiceOptions{ExtractPreviewImage: true}
+	if info := fetchPageInfo(t, withImage, options); info.imageUrl != "https://cdn.example.com/photo.jpg" {
+		t.Errorf("expected the og:image as the preview, got %q", info.imageUrl)
+	}
+	if info := fetchPageInfo(t, withoutImage, options); info.imageUrl != "" {
+		t.Errorf("expected no preview without og:image, got %q", info.imageUrl)
+	}
+	if info := fetchPageInfo(t, withImage, PageInfoServiceOptions{}); info.imageUrl != "" {
+		t.Errorf("expected no preview when it's off, got %q", info.imageUrl)
+	}
+}
+
+func TestParseUserSetStripsAt(t *testing.T) {
+	users, err := ParseUserSet([]string{"@alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users.Contains(alice) {
+		t.Fatal("expected @alice to allow alice")
+	}
+	if users.Contains(bob) {
+		t.Fatal("expected bob not allowed")
+	}
+}
+
+func TestParseUserSetMixedEntries(t *testing.T) {
+	users, err := ParseUserSet([]string{" alice ", "id:2", "12345", "@carol", "id: 77"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := []*echotron.User{
+		alice,
+		{ID: 2, Username: "renamed_bob"},
+		{ID: 12345},
+		{ID: 9, Username: "carol"},
+		{ID: 77},
+	}
+	for _, user := range allowed {
+		if !users.Contains(user) {
+			t.Errorf("expected %+v allowed by %s", user, users)
+		}
+	}
+	if users.Contains(mallory) || users.Contains(&echotron.User{ID: 3}) || users.Contains(nil) {
+		t.Errorf("expected other users rejected by %s", users)
+	}
+
+	if _, err = ParseUserSet([]string{"alice", "id:bob"}); !errorx.IsOfType(err, errorx.IllegalArgument) {
+		t.Fatalf("expected an invalid ID rejected, got %v", err)
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+	tb.send(alice, textMessage("/config archive on"))
+	tb.send(alice, textMessage("/config tags reading, later"))
+	tb.send(alice, textMessage("/config"))
+	tb.send(alice, textMessage("/config archive maybe"))
+
+	texts := tb.api.texts()
+	if len(texts) != 4 {
+		t.Fatalf("expected 4 replies, got %q", texts)
+	}
+	expected := "tags: reading, later\nunread: on\narchive: on\nshared: off"
+	if texts[2] != expected {
+		t.Fatalf("expected the settings read back as %q, got %q", expected, texts[2])
+	}
+	if texts[3] != configUsage {
+		t.Fatalf("expected the usage for an invalid value, got %q", texts[3])
+	}
+
+	tb.send(alice, textMessage("https://example.com/a"))
+	created := tb.repository.created
+	if len(created) != 1 || !created[0].IsArchived || !slices.Equal(created[0].TagNames, []string{"reading", "later"}) {
+		t.Fatalf("expected the link saved with the chat settings, got %+v", created)
+	}
+}
+
+func TestRateLimitHeadersLogged(t *testing.T) {
+	logs := captureLogs(t, log.DebugLevel)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "41")
+		w.Header().Set("X-Other", "ignored")
+		_, _ = w.Write([]byte(`{"count":0,"results":[]}`))
+	}))
+	t.Cleanup(server.Close)
+	options := LinkdingRepositoryOptions{RateLimitHeaders: []string{"X-RateLimit-Limit", "X-RateLimit-Remaining"}}
+	repository := NewLinkdingRepository(server.URL, "token", NewHttpClient(TransportOptions{}), options)
+	if _, err := repository.GetBookmarks(context.Background(), false, "", 0, 1); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, "Linkding rate limit after GET") || !strings.Contains(output, "X-RateLimit-Remaining=41") {
+		t.Fatalf("expected the rate limit header logged, got %s", output)
+	}
+	if strings.Contains(output, "X-RateLimit-Limit=") || strings.Contains(output, "X-Other") {
+		t.Fatalf("expected only the configured headers that were sent logged, got %s", output)
+	}
+}
+
+func TestFavoriteTag(t *testing.T) {
+	tb := newTestBotWithTags(t, BotOptions{}, LinkServiceOptions{}, GetTagsWithExtractors(GetFavoriteTag("favorite")))
+	tb.send(alice, textMessage("https://example.com/a #fav"))
+	tb.send(alice, textMessage("https://example.com/b #other"))
+
+	created := tb.repository.created
+	if len(created) != 2 {
+		t.Fatalf("expected 2 bookmarks, got %d", len(created))
+	}
+	if !slices.Contains(created[0].TagNames, "favorite") {
+		t.Errorf("expected the #fav link tagged favorite, got %q", created[0].TagNames)
+	}
+	if slices.Contains(created[1].TagNames, "favorite") {
+		t.Errorf("expected the other link not tagged favorite, got %q", created[1].TagNames)
+	}
+}
+
+func TestDialWithIpPreference(t *testing.T) {
+	tests := []struct {
+		preference, network, expected string
+	}{
+		{IpPreferenceAuto, "tcp", "tcp"},
+		{"", "tcp", "tcp"},
+		{IpPreferenceIpv4, "tcp", "tcp4"},
+		{IpPreferenceIpv6, "tcp", "tcp6"},
+		{IpPreferenceIpv4, "udp", "udp"},
+		{IpPreferenceIpv6, "tcp4", "tcp4"},
+	}
+	for _, test := range tests {
+		var dialed string
+		dial := dialWithIpPreference(func(_ context.Context, network, _ string) (net.Conn, error) {
+			dialed = network
+			return nil, nil
+		}, test.preference)
+		if _, err := dial(context.Background(), test.network, "example.com:443"); err != nil {
+			t.Fatal(err)
+		}
+		if dialed != test.expected {
+			t.Errorf("preference %q dialed %s as %s, expected %s", test.preference, test.network, dialed, test.expected)
+		}
+	}
+}
+
+func TestStripTitleSuffix(t *testing.T) {
+	separators := []string{" | ", " - ", ""}
+	tests := []struct {
+		title, expected string
+	}{
+		{"Post | Blog", "Post"},
+		{"Post - Part 1 | Blog", "Post - Part 1"},
+		{"Post | Part 1 - Blog", "Post | Part 1"},
+		{"Post", "Post"},
+		{" | Blog", " | Blog"},
+		{"   | Blog", "   | Blog"},
+		{"Post  |  Blog", "Post"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if stripped := stripTitleSuffix(test.title, separators); stripped != test.expected {
+			t.Errorf("stripTitleSuffix(%q) = %q, expected %q", test.title, stripped, test.expected)
+		}
+	}
+	if stripped := stripTitleSuffix("Post | Blog", nil); stripped != "Post | Blog" {
+		t.Errorf("expected the title kept without separators, got %q", stripped)
+	}
+}
+
+func TestTlsMinVersion(t *testing.T) {
+	version, err := parseTlsVersion(DefaultTlsMinVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := NewHttpClient(TransportOptions{TlsMinVersion: version}).Transport.(*http.Transport)
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("expected TLS 1.2 as the minimum, got %x", transport.TLSClientConfig.MinVersion)
+	}
+
+	version, err = parseTlsVersion(" 1.3 ")
+	if err != nil || version != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3, got %x, %v", version, err)
+	}
+	if _, err = parseTlsVersion("1.4"); !errorx.IsOfType(err, errorx.IllegalArgument) {
+		t.Fatalf("expected an unknown version rejected, got %v", err)
+	}
+}
+
+func TestDateNoteAndTag(t *testing.T) {
+	// sent at noon UTC on the last day of March, already April 1st in UTC+13
+	sentAt := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		location    *time.Location
+		date, month string
+	}{
+		{time.UTC, "2024-03-31", "2024-03"},
+		{time.FixedZone("UTC+13", 13*60*60), "2024-04-01", "2024-04"},
+	}
+	for _, test := range tests {
+		t.Run(test.location.String(), func(t *testing.T) {
+			options := BotOptions{DateNote: true, TimeWindowsLocation: test.location}
+			tb := newTestBotWithTags(t, options, LinkServiceOptions{}, GetTagsWithExtractors(GetDateTag(test.location)))
+			msg := textMessage("https://example.com/a")
+			msg.Date = int(sentAt.Unix())
+			tb.send(alice, msg)
+
+			created := tb.repository.created
+			if len(created) != 1 {
+				t.Fatalf("expected 1 bookmark, got %d", len(created))
+			}
+			if !strings.Contains(created[0].Notes, "Saved via Telegram on "+test.date) {
+				t.Errorf("expected %s noted, got %q", test.date, created[0].Notes)
+			}
+			if !slices.Equal(created[0].TagNames, []string{test.month}) {
+				t.Errorf("expected the month tag %s, got %q", test.month, created[0].TagNames)
+			}
+		})
+	}
+}
+
+func TestLinkdingStatusErrors(t *testing.T) {
+	tests := []struct {
+		status    int
+		temporary bool
+	}{
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusBadRequest, false},
+		{http.StatusForbidden, false},
+		{http.StatusNotFound, false},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			t.Cleanup(server.Close)
+			repository := NewLinkdingRepository(server.URL, "token", NewHttpClient(TransportOptions{}),
+				LinkdingRepositoryOptions{})
+			_, err := repository.CreateBookmark(context.Background(), &CreateBookmarkPayload{URL: "https://example.com"})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if temporary := errorx.HasTrait(err, errorx.Temporary()); temporary != test.temporary {
+				t.Fatalf("expected temporary %v, got %v: %+v", test.temporary, temporary, err)
+			}
+			expectedType := LinkdingRejected
+			if test.temporary {
+				expectedType = LinkdingUnavailable
+			}
+			if !errorx.IsOfType(err, expectedType) {
+				t.Fatalf("expected %s, got %+v", expectedType, err)
+			}
+			if status, _ := errorx.ExtractProperty(err, PropertyStatus); status != test.status {
+				t.Fatalf("expected status %d, got %v", test.status, status)
+			}
+		})
+	}
+}
+
+func TestReadDomains(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{ReadDomains: []string{"*.example.com", "news.example.org"}})
+	tb.send(alice, textMessage("https://example.com/a"))
+	tb.send(alice, textMessage("https://blog.example.com/b"))
+	tb.send(alice, textMessage("https://news.example.org/c"))
+	tb.send(alice, textMessage("https://example.org/d"))
+
+	unread := make(map[string]bool)
+	for _, payload := range tb.repository.created {
+		unread[payload.URL] = payload.Unread
+	}
+	expected := map[string]bool{
+		"https://example.com/a":      false,
+		"https://blog.example.com/b": false,
+		"https://news.example.org/c": false,
+		"https://example.org/d":      true,
+	}
+	for url, expectedUnread := range expected {
+		if got, found := unread[url]; !found || got != expectedUnread {
+			t.Errorf("expected %s saved with unread %v, got %v (saved %v)", url, expectedUnread, got, found)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := NewFileAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := newTestBot(t, BotOptions{RecentSaveTtl: time.Minute}, LinkServiceOptions{})
+	tb.Bot.(*bot).auditLog = auditLog
+	tb.repository.bookmarks = []*Bookmark{{ID: 100, URL: "https://example.com/b"}}
+	tb.send(alice, textMessage("https://example.com/a"))
+	tb.send(bob, textMessage("https://example.com/a"))
+	tb.send(bob, textMessage("https://example.com/b"))
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a line per save attempt, got %q", content)
+	}
+	expected := []AuditEntry{
+		{User: "alice", Chat: testChatId, Url: "https://example.com/a", Title: "Title of https://example.com/a",
+			BookmarkId: 1, Result: "saved"},
+		{User: "bob", Chat: testChatId, Url: "https://example.com/a", Result: "recent_duplicate"},
+		{User: "bob", Chat: testChatId, Url: "https://example.com/b", Result: "duplicate"},
+	}
+	for i, line := range lines {
+		var entry AuditEntry
+		if err = json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("expected a JSON line, got %q: %v", line, err)
+		}
+		if entry.Time.IsZero() {
+			t.Errorf("expected line %d timed", i)
+		}
+		entry.Time = time.Time{}
+		if entry != expected[i] {
+			t.Errorf("expected line %d to be %+v, got %+v", i, expected[i], entry)
+		}
+	}
+}
+
+func TestLinkPreviewUrl(t *testing.T) {
+	t.Run("same link without a scheme in the text", func(t *testing.T) {
+		tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+		msg := &echotron.Message{
+			Text:               "see example.com/page",
+			Entities:           []*echotron.MessageEntity{{Type: "url", Offset: 4, Length: 16}},
+			LinkPreviewOptions: &echotron.LinkPreviewOptions{URL: "http://example.com/page"},
+		}
+		tb.send(alice, msg)
+		if created := tb.repository.created; len(created) != 1 {
+			t.Fatalf("expected the link saved once, got %d bookmarks", len(created))
+		}
+		if texts := tb.api.texts(); !slices.Equal(texts, []string{"Saved!"}) {
+			t.Fatalf("expected a single saved reply, got %q", texts)
+		}
+	})
+
+	t.Run("preview of another link", func(t *testing.T) {
+		tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+		msg := textMessage("see https://example.com/text")
+		msg.LinkPreviewOptions = &echotron.LinkPreviewOptions{URL: "https://example.com/preview"}
+		tb.send(alice, msg)
+		expected := []string{"https://example.com/preview", "https://example.com/text"}
+		if urls := tb.repository.urls(); !slices.Equal(urls, expected) {
+			t.Fatalf("expected both links saved, got %v", urls)
+		}
+	})
+}
+
+func TestReplyLinkPreview(t *testing.T) {
+	for _, disabled := range []bool{true, false} {
+		tb := newTestBot(t, BotOptions{DisableReplyPreview: disabled}, LinkServiceOptions{})
+		tb.send(alice, textMessage("https://example.com/a"))
+		tb.api.mu.Lock()
+		messages := tb.api.messages
+		tb.api.mu.Unlock()
+		if len(messages) != 1 || messages[0].options == nil {
+			t.Fatalf("expected a reply with options, got %+v", messages)
+		}
+		if messages[0].options.LinkPreviewOptions.IsDisabled != disabled {
+			t.Errorf("expected the reply preview disabled %v, got %+v", disabled, messages[0].options.LinkPreviewOptions)
+		}
+	}
+}
+
+var correlationIdPattern = regexp.MustCompile(`correlation_id=(\S+)`)
+
+// correlationIds returns the distinct correlation IDs in the logs and how many lines carry one
+func correlationIds(logs string) ([]string, int) {
+	matches := correlationIdPattern.FindAllStringSubmatch(logs, -1)
+	ids := make([]string, 0, len(matches))
+	for _, match := range matches {
+		ids = append(ids, match[1])
+	}
+	return distinct(ids), len(matches)
+}
+
+func TestCorrelationIdPerUpdate(t *testing.T) {
+	logs := captureLogs(t, log.DebugLevel)
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+	tb.send(alice, textMessage("https://example.com/a"))
+	output := logs.String()
+	first, lines := correlationIds(output)
+	if total := strings.Count(output, "\n"); len(first) != 1 || lines < 2 || lines != total {
+		t.Fatalf("expected all %d lines of the update under one correlation ID, got %v in %d lines", total, first, lines)
+	}
+
+	tb.send(alice, textMessage("https://example.com/b"))
+	ids, _ := correlationIds(logs.String())
+	if len(ids) != 2 || ids[0] != first[0] {
+		t.Fatalf("expected the next update under a new correlation ID, got %v", ids)
+	}
+}
+
+func TestCustomBookmarksPath(t *testing.T) {
+	var mu sync.Mutex
+	paths := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		switch r.Method {
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"id":7,"url":"https://example.com"}`))
+		case http.MethodGet:
+			_, _ = w.Write([]byte(`{"count":0,"results":[]}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(server.Close)
+	options := LinkdingRepositoryOptions{BookmarksPath: "linkding/api/v2/bookmarks"}
+	repository := NewLinkdingRepository(server.URL+"/base", "token", NewHttpClient(TransportOptions{}), options)
+
+	ctx := context.Background()
+	if _, err := repository.CreateBookmark(ctx, &CreateBookmarkPayload{URL: "https://example.com"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if _, err := repository.GetBookmarks(ctx, true, "", 0, 10); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := repository.DeleteBookmark(ctx, 7); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expected := []string{
+		"POST /base/linkding/api/v2/bookmarks/",
+		"GET /base/linkding/api/v2/bookmarks/archived/",
+		"DELETE /base/linkding/api/v2/bookmarks/7/",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(paths, expected) {
+		t.Fatalf("expected %q, got %q", expected, paths)
+	}
+}
+
+func TestNoUrlsAndNoneSavableReplies(t *testing.T) {
+	tests := []struct {
+		name, text, reply string
+	}{
+		{"no URLs", "nothing to see", "No URLs found in the message"},
+		{"none savable", "ftp://example.com/file javascript://alert", "No savable URLs in the message (all blocked or invalid)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tb := newTestBot(t, BotOptions{ReplyOnNoUrls: true}, LinkServiceOptions{})
+			tb.send(alice, textMessage(test.text))
+			if texts := tb.api.texts(); !slices.Equal(texts, []string{test.reply}) {
+				t.Fatalf("expected %q, got %q", test.reply, texts)
+			}
+			if len(tb.repository.urls()) != 0 {
+				t.Fatal("expected nothing saved")
+			}
+		})
+	}
+}
+
+func TestCaptionOnlyMessage(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+	caption := "source: https://example.com/photo #archive"
+	tb.send(alice, &echotron.Message{
+		Photo:           []*echotron.PhotoSize{{FileID: "photo", Width: 90, Height: 90}},
+		Caption:         caption,
+		CaptionEntities: textEntities(caption),
+	})
+
+	created := tb.repository.created
+	if len(created) != 1 || created[0].URL != "https://example.com/photo" {
+		t.Fatalf("expected the caption link saved, got %+v", created)
+	}
+	if !created[0].IsArchived {
+		t.Error("expected the caption hashtag applied")
+	}
+	if texts := tb.api.texts(); !slices.Equal(texts, []string{"Saved!"}) {
+		t.Fatalf("expected a saved reply, got %q", texts)
+	}
+}
+
+func TestGetDescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		msg         *echotron.Message
+		description string
+	}{
+		{"desc only", &echotron.Message{Text: "desc: Worth a read"}, "Worth a read"},
+		{"title and desc", &echotron.Message{Text: "Great post https://example.com\n  DESC:  Worth a read "}, "Worth a read"},
+		{"desc in caption", &echotron.Message{Caption: "https://example.com\ndesc: From the photo"}, "From the photo"},
+		{"empty desc skipped", &echotron.Message{Text: "desc:\ndesc: Second"}, "Second"},
+		{"none", &echotron.Message{Text: "https://example.com describes it"}, ""},
+	}
+	for _, test := range tests {
+		if description := GetDescription(test.msg); description != test.description {
+			t.Errorf("%s: expected %q, got %q", test.name, test.description, description)
+		}
+	}
+
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+	tb.pageInfo.pages = map[string]*PageInfo{
+		"https://example.com/a": {url: "https://example.com/a", title: "Page", description: "From the page"},
+	}
+	tb.send(alice, textMessage("https://example.com/a\ndesc: Mine"))
+	if created := tb.repository.created; len(created) != 1 || created[0].Title != "Page" || created[0].Description != "Mine" {
+		t.Fatalf("expected the page title kept and the description replaced, got %+v", created)
+	}
+}
+
+// telegramError has the ErrorCode method of echotron.APIError, whose fields can't be set outside echotron
+type telegramError struct {
+	code int
+}
+
+func (e telegramError) Error() string {
+	return fmt.Sprintf("telegram error %d", e.code)
+}
+
+func (e telegramError) ErrorCode() int {
+	return e.code
+}
+
+func TestIsPollConflict(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		conflict bool
+	}{
+		{"conflict", telegramError{http.StatusConflict}, true},
+		{"wrapped conflict", fmt.Errorf("polling: %w", telegramError{http.StatusConflict}), true},
+		{"other status", telegramError{http.StatusBadGateway}, false},
+		{"not an API error", fmt.Errorf("connection reset"), false},
+		{"nil", nil, false},
+	}
+	for _, test := range tests {
+		if conflict := isPollConflict(test.err); conflict != test.conflict {
+			t.Errorf("%s: expected %v, got %v", test.name, test.conflict, conflict)
+		}
+	}
+}
+
+func TestTagAliases(t *testing.T) {
+	aliases, err := parseTagAliases([]string{"r=reading to-read", " #W = work "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := newTestBotWithTags(t, BotOptions{}, LinkServiceOptions{}, GetTagsWithExtractors(GetTagsFromAliases(aliases)))
+	tb.send(alice, textMessage("https://example.com/a #R #w #other"))
+	created := tb.repository.created
+	if len(created) != 1 || !slices.Equal(created[0].TagNames, []string{"reading", "to-read", "work"}) {
+		t.Fatalf("expected the aliases expanded, got %+v", created)
+	}
+
+	for _, entry := range []string{"r", "=reading", "r=", "r= "} {
+		if _, err = parseTagAliases([]string{entry}); !errorx.IsOfType(err, errorx.IllegalArgument) {
+			t.Errorf("expected %q rejected, got %v", entry, err)
+		}
+	}
+}
+
+func TestDeleteCommand(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+	tb.send(alice, textMessage("https://example.com/a"))
+	tb.send(alice, textMessage("/delete\nhttps://example.com/a"))
+	tb.send(alice, textMessage("/delete https://example.com/a"))
+	tb.send(alice, textMessage("/delete"))
+
+	expected := []string{"Saved!", "Deleted", "Not found", "Usage: /delete <url>"}
+	if texts := tb.api.texts(); !slices.Equal(texts, expected) {
+		t.Fatalf("expected %q, got %q", expected, texts)
+	}
+	if urls := tb.repository.urls(); len(urls) != 0 {
+		t.Fatalf("expected the bookmark deleted, got %v", urls)
+	}
+}
+
+func TestPageWithoutMetadata(t *testing.T) {
+	server := newPageServer(t, "<html><head></head><body></body></html>")
+	pageInfoService := NewPageInfoService(NewHttpClient(TransportOptions{}), PageInfoServiceOptions{})
+	for _, fallback := range []bool{true, false} {
+		repository := &fakeRepository{}
+		service := NewLinkdingLinkService(repository, pageInfoService, LinkServiceOptions{TitleFromUrlFallback: fallback})
+		if _, err := service.Save(context.Background(), server.URL+"/page", &SaveOptions{}); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		expected := ""
+		if fallback {
+			expected = strings.TrimPrefix(server.URL, "http://") + "/page"
+		}
+		if title := repository.created[0].Title; title != expected {
+			t.Errorf("expected title %q with the URL fallback %v, got %q", expected, fallback, title)
+		}
+		if description := repository.created[0].Description; description != "" {
+			t.Errorf("expected no description, got %q", description)
+		}
+	}
+}
+
+func TestSourceNote(t *testing.T) {
+	page, err := os.ReadFile(filepath.Join("testdata", "pages", "source.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newPageServer(t, string(page))
+	pageInfoService := NewPageInfoService(NewHttpClient(TransportOptions{}), PageInfoServiceOptions{})
+	repository := &fakeRepository{}
+	service := NewLinkdingLinkService(repository, pageInfoService, LinkServiceOptions{SourceNote: true})
+	if _, err = service.Save(context.Background(), server.URL+"/page", &SaveOptions{Notes: "Mine"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if notes := repository.created[0].Notes; notes != "Site: Example Blog, Author: Jane Doe\n\nMine" {
+		t.Fatalf("expected the site and author noted before the message notes, got %q", notes)
+	}
+}
+
+func TestNoUrlsSilentWithoutReply(t *testing.T) {
+	tb := newTestBot(t, BotOptions{ReplyOnNoUrls: false}, LinkServiceOptions{})
+	tb.send(alice, textMessage("just chatting"))
+	if texts := tb.api.texts(); len(texts) != 0 {
+		t.Fatalf("expected no reply, got %q", texts)
+	}
+	if len(tb.pageInfo.fetches) != 0 || len(tb.repository.urls()) != 0 {
+		t.Fatal("expected nothing fetched or saved")
+	}
+}
+
+func TestRedirectLoopStopsAtMaxRedirects(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	}))
+	t.Cleanup(server.Close)
+
+	service := NewPageInfoService(NewHttpClient(TransportOptions{MaxRedirects: 3}), PageInfoServiceOptions{})
+	_, err := service.GetPageInfo(context.Background(), server.URL+"/loop")
+	if err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+		t.Fatalf("expected the redirect loop stopped, got %v", err)
+	}
+	if hits.Load() != 4 {
+		t.Fatalf("expected the page and 3 redirects requested, got %d requests", hits.Load())
+	}
+}
+
+func TestLinkdingScrapeFallback(t *testing.T) {
+	options := LinkServiceOptions{LinkdingScrapeFallback: true, TitleFromUrlFallback: true}
+	tests := []struct {
+		name        string
+		pageInfo    *fakePageInfoService
+		title       string
+		description string
+		saveOptions SaveOptions
+	}{
+		{
+			name: "fetched locally",
+			pageInfo: &fakePageInfoService{pages: map[string]*PageInfo{
+				"https://example.com/a": {url: "https://example.com/a", title: "Local", description: "From the page"},
+			}},
+			title:       "Local",
+			description: "From the page",
+		},
+		{
+			name:     "fetch failed",
+			pageInfo: &fakePageInfoService{err: errorx.ExternalError.New("page responded with status 503")},
+		},
+		{
+			name:        "fetch failed with a desc: line",
+			pageInfo:    &fakePageInfoService{err: errorx.ExternalError.New("page responded with status 503")},
+			description: "Mine",
+			saveOptions: SaveOptions{Description: "Mine"},
+		},
+		{
+			name: "page without a title",
+			pageInfo: &fakePageInfoService{pages: map[string]*PageInfo{
+				"https://example.com/a": {url: "https://example.com/a", description: "From the page"},
+			}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repository := &fakeRepository{}
+			service := NewLinkdingLinkService(repository, test.pageInfo, options)
+			if _, err := service.Save(context.Background(), "https://example.com/a", &test.saveOptions); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			payload := repository.created[0]
+			if payload.Title != test.title || payload.Description != test.description {
+				t.Fatalf("expected title %q and description %q, got %q and %q",
+					test.title, test.description, payload.Title, payload.Description)
+			}
+		})
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		level    string
+		expected log.Level
+	}{
+		{"trace", log.TraceLevel},
+		{"debug", log.DebugLevel},
+		{" INFO ", log.InfoLevel},
+		{"warn", log.WarnLevel},
+		{"warning", log.WarnLevel},
+		{"error", log.ErrorLevel},
+	}
+	for _, test := range tests {
+		level, err := parseLogLevel(test.level)
+		if err != nil || level != test.expected {
+			t.Errorf("parseLogLevel(%q) = %v, %v, expected %v", test.level, level, err, test.expected)
+		}
+	}
+
+	_, err := parseLogLevel("verbose")
+	if !errorx.IsOfType(err, errorx.IllegalArgument) || !strings.Contains(err.Error(), "debug") {
+		t.Fatalf("expected an unknown level rejected with the accepted names, got %v", err)
+	}
+}
+
+func TestRawHashtagSkipsFetch(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{TitleFromUrlFallback: true})
+	tb.send(alice, textMessage("https://example.com/slow/ #raw"))
+	if len(tb.pageInfo.fetches) != 0 {
+		t.Fatalf("expected no page fetch, got %v", tb.pageInfo.fetches)
+	}
+	created := tb.repository.created
+	if len(created) != 1 || created[0].Title != "example.com/slow" {
+		t.Fatalf("expected the link saved titled after its URL, got %+v", created)
+	}
+}
+
+func TestExtractedUrlCountsLogged(t *testing.T) {
+	logs := captureLogs(t, log.DebugLevel)
+	msg := textMessage("https://example.com/a https://example.com/a ftp://example.com/b")
+	msg.LinkPreviewOptions = &echotron.LinkPreviewOptions{URL: "https://example.com/a"}
+	options := BotOptions{AllowedSchemes: DefaultAllowedSchemes}
+	messageUrls(log.NewEntry(log.StandardLogger()), msg, NewUrlExtractors(true), options)
+
+	var line string
+	for _, l := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(l, "Extracted URLs") {
+			line = l
+		}
+	}
+	for _, field := range []string{
+		"GetUrlsFromLinkPreview=1",
+		"GetUrlsFromEntities=3",
+		"GetUrlsFromCaptionEntities=0",
+		"GetUrlsFromViaBot=0",
+		"distinct=2",
+		"valid=1",
+	} {
+		if !strings.Contains(line, field) {
+			t.Errorf("expected %s in %q", field, line)
+		}
+	}
+}
+
+func TestSaveAllSummary(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{MaxUrlLength: 40})
+	tb.repository.bookmarks = []*Bookmark{{ID: 100, URL: "https://example.com/old"}}
+	long := "https://example.com/" + strings.Repeat("a", 40)
+	tb.send(alice, textMessage("https://example.com/new https://example.com/old "+long))
+
+	texts := tb.api.texts()
+	expected := "1 new, 1 duplicate, 1 failed\n" + long + " - URL too long."
+	if !slices.Equal(texts, []string{expected}) {
+		t.Fatalf("expected %q, got %q", expected, texts)
+	}
+}
+
+func TestNormalizeUrl(t *testing.T) {
+	tests := []struct {
+		normalization UrlNormalization
+		raw, expected string
+	}{
+		{UrlNormalization{}, "http://www.example.com/page", "http://www.example.com/page"},
+		{UrlNormalization{StripWww: true}, "http://www.example.com/page", "http://example.com/page"},
+		{UrlNormalization{StripWww: true}, "https://www.example.com:8443/page", "https://example.com:8443/page"},
+		{UrlNormalization{StripWww: true}, "https://wwwexample.com/page", "https://wwwexample.com/page"},
+		{UrlNormalization{ForceHttps: true}, "http://www.example.com/page", "https://www.example.com/page"},
+		{UrlNormalization{ForceHttps: true}, "http://example.com:443/page", "https://example.com/page"},
+		{UrlNormalization{ForceHttps: true}, "http://example.com:8080/page", "https://example.com:8080/page"},
+		{UrlNormalization{StripWww: true, ForceHttps: true}, "http://www.example.com/page", "https://example.com/page"},
+	}
+	for _, test := range tests {
+		normalized, err := normalizeUrl(test.raw, test.normalization)
+		if err != nil || normalized != test.expected {
+			t.Errorf("normalizeUrl(%q, %+v) = %q, %v, expected %q",
+				test.raw, test.normalization, normalized, err, test.expected)
+		}
+	}
+}
+
+func TestUndoIsPerUser(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+	tb.send(alice, textMessage("https://example.com/alice"))
+	tb.send(bob, textMessage("https://example.com/bob"))
+	tb.send(alice, textMessage("/undo"))
+	tb.send(alice, textMessage("/undo"))
+
+	if urls := tb.repository.urls(); !slices.Equal(urls, []string{"https://example.com/bob"}) {
+		t.Fatalf("expected only alice's link removed, got %v", urls)
+	}
+	texts := tb.api.texts()
+	if !slices.Equal(texts[2:], []string{"Removed https://example.com/alice", "Nothing to undo"}) {
+		t.Fatalf("expected alice to undo only her own save, got %q", texts)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	logs := captureLogs(t, log.InfoLevel)
+	if delay := poll(func() error { return nil }); delay != pollRetryDelay {
+		t.Fatalf("expected the usual retry delay, got %s", delay)
+	}
+	if output := logs.String(); output != "" {
+		t.Fatalf("expected nothing logged at info level for a poll, got %s", output)
+	}
+
+	if delay := poll(func() error { return telegramError{http.StatusConflict} }); delay != pollConflictBackoff {
+		t.Fatalf("expected the conflict backoff, got %s", delay)
+	}
+	if !strings.Contains(logs.String(), "Another instance is running") {
+		t.Fatalf("expected the conflict logged, got %s", logs.String())
+	}
+	if delay := poll(func() error { return fmt.Errorf("connection reset") }); delay != pollRetryDelay {
+		t.Fatalf("expected the usual retry delay, got %s", delay)
+	}
+	if !strings.Contains(logs.String(), "Polling stopped, restarting: connection reset") {
+		t.Fatalf("expected the error logged, got %s", logs.String())
+	}
+}
+
+func TestWebhookMux(t *testing.T) {
+	handled := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+	})
+	tests := []struct {
+		name, path, method, target string
+		status, handled            int
+	}{
+		{"configured path", "/hook/secret", http.MethodPost, "/hook/secret", http.StatusOK, 1},
+		{"path without leading slash", "hook", http.MethodPost, "/hook", http.StatusOK, 1},
+		{"trailing slash path", "/hook/", http.MethodPost, "/hook/", http.StatusOK, 1},
+		{"below a trailing slash path", "/hook/", http.MethodPost, "/hook/other", http.StatusNotFound, 0},
+		{"wrong path", "/hook/secret", http.MethodPost, "/hook/guess", http.StatusNotFound, 0},
+		{"wrong method", "/hook/secret", http.MethodGet, "/hook/secret", http.StatusMethodNotAllowed, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handled = 0
+			rec := httptest.NewRecorder()
+			newWebhookMux(test.path, handler).ServeHTTP(rec, httptest.NewRequest(test.method, test.target, nil))
+			if rec.Code != test.status || handled != test.handled {
+				t.Fatalf("expected status %d and %d handled, got %d and %d", test.status, test.handled, rec.Code, handled)
+			}
+		})
+	}
+}
+
+func TestRefreshCommand(t *testing.T) {
+	tb := newTestBot(t, BotOptions{}, LinkServiceOptions{})
+	tb.pageInfo.pages = map[string]*PageInfo{
+		"https://example.com/a": {url: "https://example.com/a", title: "Old title", description: "Old"},
+	}
+	tb.send(alice, textMessage("https://example.com/a"))
+
+	tb.pageInfo.mu.Lock()
+	tb.pageInfo.pages["https://example.com/a"] = &PageInfo{url: "https://example.com/a", title: "New title"}
+	tb.pageInfo.mu.Unlock()
+	tb.send(alice, textMessage("/refresh https://example.com/a"))
+	tb.send(alice, textMessage("/refresh https://example.com/missing"))
+
+	expected := []string{"Saved!", "Refreshed: New title", "Not found"}
+	if texts := tb.api.texts(); !slices.Equal(texts, expected) {
+		t.Fatalf("expected %q, got %q", expected, texts)
+	}
+	bookmark := tb.repository.bookmarks[0]
+	if bookmark.Title != "New title" || bookmark.Description != "Old" {
+		t.Fatalf("expected the title refreshed and the description kept, got %q and %q",
+			bookmark.Title, bookmark.Description)
+	}
+	if fetches := tb.pageInfo.fetches; len(fetches) != 2 {
+		t.Fatalf("expected the page fetched again, got %v", fetches)
+	}
+}
+
+func TestBlockPrivateIps(t *testing.T) {
+	tests := []struct {
+		address string
+		blocked bool
+	}{
+		{"127.0.0.1:80", true},
+		{"[::1]:80", true},
+		{"10.0.0.1:443", true},
+		{"192.168.1.1:80", true},
+		{"169.254.169.254:80", true},
+		{"100.64.0.1:80", true},
+		{"[::ffff:127.0.0.1]:80", true},
+		{"0.0.0.0:80", true},
+		{"93.184.216.34:443", false},
+		{"[2606:4700::1111]:443", false},
+	}
+	for _, test := range tests {
+		err := blockPrivateIps("tcp", test.address, nil)
+		if blocked := errorx.IsOfType(err, errorx.RejectedOperation); blocked != test.blocked {
+			t.Errorf("blockPrivateIps(%s) = %v, expected blocked %v", test.address, err, test.blocked)
+		}
+		if !test.blocked && err != nil {
+			t.Errorf("expected %s allowed, got %v", test.address, err)
+		}
+	}
+}
+
+func TestGetPageInfoBlocksPrivateIps(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = w.Write([]byte("<html><head><title>Internal</title></head></html>"))
+	}))
+	t.Cleanup(server.Close)
+
+	service := NewPageInfoService(NewHttpClient(TransportOptions{BlockPrivateIps: true}), PageInfoServiceOptions{})
+	_, err := service.GetPageInfo(context.Background(), server.URL)
+	if !errorx.IsOfType(err, errorx.RejectedOperation) {
+		t.Fatalf("expected the localhost fetch rejected, got %+v", err)
+	}
+	if hits.Load() != 0 {
+		t.Fatalf("expected the server not reached, got %d requests", hits.Load())
+	}
+}
+
+func TestFetchOverrideSkip(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	t.Cleanup(server.Close)
+	overrides, err := parseFetchOverrides([]string{"127.0.0.1=skip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := NewPageInfoService(NewHttpClient(TransportOptions{}), PageInfoServiceOptions{FetchOverrides: overrides})
+	info, err := service.GetPageInfo(context.Background(), server.URL+"/slow/")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if expected := titleFromUrl(server.URL + "/slow/"); info.title != expected {
+		t.Fatalf("expected the title %q from the URL, got %q", expected, info.title)
+	}
+	if hits.Load() != 0 {
+		t.Fatalf("expected the page not fetched, got %d requests", hits.Load())
+	}
+}
+
+func TestFetchOverrideTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+			_, _ = w.Write([]byte("<html><head><title>Slow</title></head></html>"))
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	options := PageInfoServiceOptions{Timeout: 5 * time.Second}
+
+	service := NewPageInfoService(NewHttpClient(TransportOptions{}), options)
+	if _, err := service.GetPageInfo(context.Background(), server.URL); err != nil {
+		t.Fatalf("expected the slow page fetched within the global timeout, got %+v", err)
+	}
+
+	options.FetchOverrides = []FetchOverride{{Domain: "127.0.0.1", Timeout: 20 * time.Millisecond}}
+	service = NewPageInfoService(NewHttpClient(TransportOptions{}), options)
+	if _, err := service.GetPageInfo(context.Background(), server.URL); err == nil {
+		t.Fatal("expected the override timeout to fail the slow page")
+	}
+}
+
+func TestParseFetchOverrides(t *testing.T) {
+	overrides, err := parseFetchOverrides([]string{"*.example.com = 30s", "slow.example.org=skip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FetchOverride{
+		{Domain: "*.example.com", Timeout: 30 * time.Second},
+		{Domain: "slow.example.org", SkipFetch: true},
+	}
+	if !slices.Equal(overrides, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, overrides)
+	}
+
+	for _, entry := range []string{"domain=", "=30s", "domain=-1s", "domain=abc", "domain"} {
+		if _, err = parseFetchOverrides([]string{entry}); !errorx.IsOfType(err, errorx.IllegalArgument) {
+			t.Errorf("expected %q rejected, got %v", entry, err)
+		}
+	}
+}
+
+func TestSaveDocuments(t *testing.T) {
+	tests := []struct {
+		name, fileName, title, notes string
+	}{
+		{"named document", "paper.pdf", "paper.pdf", "paper.pdf\n\nRead before Friday"},
+		{"unnamed document", "", "Document", "Document\n\nRead before Friday"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tb := newTestBot(t, BotOptions{SaveDocuments: true}, LinkServiceOptions{})
+			msg := &echotron.Message{
+				ID:       7,
+				Document: &echotron.Document{FileID: "file", FileName: test.fileName},
+				Caption:  "Read before Friday",
+			}
+			tb.send(alice, msg)
+
+			created := tb.repository.created
+			if len(created) != 1 {
+				t.Fatalf("expected 1 bookmark, got %d", len(created))
+			}
+			if expected := fmt.Sprintf("https://t.me/#note/%d/7", testChatId); created[0].URL != expected {
+				t.Errorf("expected the placeholder URL %s, got %s", expected, created[0].URL)
+			}
+			if created[0].URL != notePlaceholderUrl(msg) {
+				t.Errorf("expected the note placeholder URL, got %s", created[0].URL)
+			}
+			if created[0].Title != test.title || created[0].Notes != test.notes {
+				t.Errorf("expected title %q and notes %q, got %q and %q",
+					test.title, test.notes, created[0].Title, created[0].Notes)
+			}
+			if texts := tb.api.texts(); !slices.Equal(texts, []string{"Saved as a note!"}) {
+				t.Errorf("expected the note reply, got %q", texts)
+			}
+		})
+	}
+}
+
+func TestFetchProxy(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/page", nil)
+	for _, raw := range []string{"socks5://127.0.0.1:9050", "http://proxy.internal:3128"} {
+		proxyUrl, err := parseProxyUrl(raw)
+		if err != nil {
+			t.Fatalf("expected %s accepted, got %v", raw, err)
+		}
+		transport := NewHttpClient(TransportOptions{Proxy: proxyUrl, BlockPrivateIps: true}).Transport.(*http.Transport)
+		proxy, err := transport.Proxy(req)
+		if err != nil || proxy == nil || proxy.String() != raw {
+			t.Errorf("expected fetches routed through %s, got %v, %v", raw, proxy, err)
+		}
+
+		// the linkding client is built from the options without the fetch proxy
+		transport = NewHttpClient(TransportOptions{}).Transport.(*http.Transport)
+		if proxy, _ = transport.Proxy(req); proxy != nil && proxy.String() == raw {
+			t.Errorf("expected linkding calls not routed through %s", raw)
+		}
+	}
+
+	if proxyUrl, err := parseProxyUrl(""); proxyUrl != nil || err != nil {
+		t.Errorf("expected no proxy when empty, got %v, %v", proxyUrl, err)
+	}
+	for _, raw := range []string{"ftp://proxy.internal:21", "socks5://", "socks5:///path", "127.0.0.1:9050"} {
+		if _, err := parseProxyUrl(raw); err == nil {
+			t.Errorf("expected %q rejected", raw)
+		}
+	}
+}